@@ -1,10 +1,14 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -12,6 +16,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 
+	rd "github.com/longhorn/upgrade-responder/rancherdesktop"
 	"github.com/longhorn/upgrade-responder/upgraderesponder"
 )
 
@@ -28,16 +33,64 @@ const (
 	EnvInfluxDBUser                  = "INFLUXDB_USER"
 	FlagInfluxDBPass                 = "influxdb-pass"
 	EnvInfluxDBPass                  = "INFLUXDB_PASS"
+	FlagInfluxDBOrg                  = "influxdb-org"
+	EnvInfluxDBOrg                   = "INFLUXDB_ORG"
+	FlagInfluxDBBucket               = "influxdb-bucket"
+	EnvInfluxDBBucket                = "INFLUXDB_BUCKET"
+	FlagInfluxDBToken                = "influxdb-token"
+	EnvInfluxDBToken                 = "INFLUXDB_TOKEN"
+	FlagInfluxDBSkipSetup            = "influxdb-skip-setup"
+	EnvInfluxDBSkipSetup             = "INFLUXDB_SKIP_SETUP"
 	FlagQueryPeriod                  = "query-period"
 	EnvQueryPeriod                   = "QUERY_PERIOD"
+	FlagGeoResolver                  = "geo-resolver"
+	EnvGeoResolver                   = "GEO_RESOLVER"
+	FlagGeoCSV                       = "geo-csv"
+	EnvGeoCSV                        = "GEO_CSV"
 	FlagGeoDB                        = "geodb"
 	EnvGeoDB                         = "GEODB"
+	FlagASNDB                        = "asndb"
+	EnvASNDB                         = "ASNDB"
+	FlagGeoDBReloadInterval          = "geodb-reload-interval"
+	EnvGeoDBReloadInterval           = "GEODB_RELOAD_INTERVAL"
+	FlagTrustedProxies               = "trusted-proxies"
+	EnvTrustedProxies                = "TRUSTED_PROXIES"
 	FlagPort                         = "port"
 	EnvPort                          = "PORT"
 	FlagCacheSyncInterval            = "cache-sync-interval"
 	EnvCacheSyncInterval             = "CACHE_SYNC_INTERVAL"
 	FlagCacheSize                    = "cache-size"
 	EnvCacheSize                     = "CACHE_SIZE"
+	FlagCacheQueueSize               = "cache-queue-size"
+	EnvCacheQueueSize                = "CACHE_QUEUE_SIZE"
+	FlagAggregateRequests            = "aggregate-requests"
+	EnvAggregateRequests             = "AGGREGATE_REQUESTS"
+	FlagConfigReloadInterval         = "config-reload-interval"
+	EnvConfigReloadInterval          = "CONFIG_RELOAD_INTERVAL"
+	FlagMetricsBackend               = "metrics-backend"
+	EnvMetricsBackend                = "METRICS_BACKEND"
+	FlagShutdownTimeout              = "shutdown-timeout"
+	EnvShutdownTimeout               = "SHUTDOWN_TIMEOUT"
+	FlagSpoolDir                     = "spool-dir"
+	EnvSpoolDir                      = "SPOOL_DIR"
+	FlagSpoolMaxSize                 = "spool-max-size"
+	EnvSpoolMaxSize                  = "SPOOL_MAX_SIZE"
+	FlagSpoolDropPolicy              = "spool-drop-policy"
+	EnvSpoolDropPolicy               = "SPOOL_DROP_POLICY"
+	FlagLocalStorageDir              = "local-storage-dir"
+	EnvLocalStorageDir               = "LOCAL_STORAGE_DIR"
+	FlagLocalStorageRetention        = "local-storage-retention"
+	EnvLocalStorageRetention         = "LOCAL_STORAGE_RETENTION"
+
+	FlagFailOnWarnings = "fail-on-warnings"
+
+	FlagSimulateAppVersion      = "app-version"
+	FlagSimulatePlatform        = "platform"
+	FlagSimulatePlatformVersion = "platform-version"
+	FlagSimulateExtraInfo       = "extra-info"
+	FlagSimulateRequests        = "requests"
+	FlagSimulateTime            = "time"
+	FlagSimulateCountry         = "country"
 )
 
 func main() {
@@ -60,6 +113,9 @@ func main() {
 
 	app.Commands = []cli.Command{
 		UpgradeResponderCmd(),
+		ValidateCmd(),
+		SimulateCmd(),
+		AnalyzeCmd(),
 	}
 
 	if err := app.Run(os.Args); err != nil {
@@ -81,6 +137,23 @@ func UpgradeResponderCmd() cli.Command {
 				EnvVar: EnvApplicationName,
 				Usage:  "Specify the name of the application that is using this upgrade checker. This will be used to create a database name <application-name>_upgrade_responder in the InfluxDB to store all data for this upgrade checker",
 			},
+			cli.StringFlag{
+				Name:   FlagMetricsBackend,
+				EnvVar: EnvMetricsBackend,
+				Value:  upgraderesponder.MetricsBackendInfluxDB,
+				Usage:  fmt.Sprintf("Specify where the server records requests. One of: %v, %v, %v, %v, %v", upgraderesponder.MetricsBackendInfluxDB, upgraderesponder.MetricsBackendInfluxDB2, upgraderesponder.MetricsBackendPrometheus, upgraderesponder.MetricsBackendLocal, upgraderesponder.MetricsBackendNone),
+			},
+			cli.StringFlag{
+				Name:   FlagLocalStorageDir,
+				EnvVar: EnvLocalStorageDir,
+				Usage:  "Specify the directory requests are stored in. Only used by the local metrics backend",
+			},
+			cli.IntFlag{
+				Name:   FlagLocalStorageRetention,
+				EnvVar: EnvLocalStorageRetention,
+				Value:  90,
+				Usage:  "Specify how long requests are kept. Measured in day. 0 keeps them forever. Only used by the local metrics backend",
+			},
 			cli.StringFlag{
 				Name:   FlagInfluxDBURL,
 				EnvVar: EnvInfluxDBURL,
@@ -96,17 +169,64 @@ func UpgradeResponderCmd() cli.Command {
 				EnvVar: EnvInfluxDBPass,
 				Usage:  "Specify the InfluxDB password",
 			},
+			cli.StringFlag{
+				Name:   FlagInfluxDBOrg,
+				EnvVar: EnvInfluxDBOrg,
+				Usage:  "Specify the InfluxDB organization. Only used by InfluxDB 2.x and later",
+			},
+			cli.StringFlag{
+				Name:   FlagInfluxDBBucket,
+				EnvVar: EnvInfluxDBBucket,
+				Usage:  "Specify the InfluxDB bucket. Defaults to <application-name>_upgrade_responder. Only used by InfluxDB 2.x and later",
+			},
+			cli.StringFlag{
+				Name:   FlagInfluxDBToken,
+				EnvVar: EnvInfluxDBToken,
+				Usage:  "Specify the InfluxDB API token. Only used by InfluxDB 2.x and later",
+			},
+			cli.BoolFlag{
+				Name:   FlagInfluxDBSkipSetup,
+				EnvVar: EnvInfluxDBSkipSetup,
+				Usage:  "Do not create the InfluxDB bucket and down sampling tasks. Required for InfluxDB 3.x. Only used by InfluxDB 2.x and later",
+			},
 			cli.StringFlag{
 				Name:   FlagQueryPeriod,
 				EnvVar: EnvQueryPeriod,
 				Value:  "1h",
 				Usage:  "Specify the period for how often each instance of the application makes the request. Cannot change after set for the first time. This value should be the same as time in GROUP BY clause in Grafana",
 			},
+			cli.StringFlag{
+				Name:   FlagGeoResolver,
+				EnvVar: EnvGeoResolver,
+				Usage:  fmt.Sprintf("Specify how the locations of requests are resolved. One of: %v, %v, %v. Defaults to %v if --%v is set, and to %v otherwise", upgraderesponder.GeoResolverMMDB, upgraderesponder.GeoResolverCSV, upgraderesponder.GeoResolverNone, upgraderesponder.GeoResolverMMDB, FlagGeoDB, upgraderesponder.GeoResolverNone),
+			},
 			cli.StringFlag{
 				Name:   FlagGeoDB,
 				EnvVar: EnvGeoDB,
 				Usage:  "Specify the path of to GeoDB file",
 			},
+			cli.StringFlag{
+				Name:   FlagGeoCSV,
+				EnvVar: EnvGeoCSV,
+				Usage:  "Specify the path of the CSV file mapping CIDRs to countries, used by the csv geo resolver",
+			},
+			cli.StringFlag{
+				Name:   FlagASNDB,
+				EnvVar: EnvASNDB,
+				Usage:  "Specify the path of an optional GeoLite2-ASN database file, used to record the autonomous system requests come from",
+			},
+			cli.IntFlag{
+				Name:   FlagGeoDBReloadInterval,
+				EnvVar: EnvGeoDBReloadInterval,
+				Value:  3600,
+				Usage:  "Specify the period for how often the server should check the GeoDB and ASN database files for changes. Measured in second. Set to 0 to disable",
+			},
+			cli.StringFlag{
+				Name:   FlagTrustedProxies,
+				EnvVar: EnvTrustedProxies,
+				Value:  strings.Join(upgraderesponder.DefaultTrustedProxies, ","),
+				Usage:  "Specify the comma-separated CIDRs or IP addresses of the proxies in front of the server, whose Forwarded, X-Forwarded-For and X-Real-IP headers are used to find the IP of the client. Set to an empty string to ignore these headers",
+			},
 			cli.IntFlag{
 				Name:   FlagPort,
 				EnvVar: EnvPort,
@@ -125,6 +245,46 @@ func UpgradeResponderCmd() cli.Command {
 				Value:  100,
 				Usage:  "Specify the cache size of server. Once the number of data points in cache is bigger than cache size, the server flush and write all data in the cache to influxDB.",
 			},
+			cli.IntFlag{
+				Name:   FlagCacheQueueSize,
+				EnvVar: EnvCacheQueueSize,
+				Value:  10000,
+				Usage:  "Specify the maximum number of data points waiting to be written to database. Once it is reached, new data points are dropped until the cache is flushed. Must not be smaller than the cache size. Not used with --spool-dir",
+			},
+			cli.BoolFlag{
+				Name:   FlagAggregateRequests,
+				EnvVar: EnvAggregateRequests,
+				Usage:  "Write one data point per set of tags and query period in each sync with the number of requests in the field count, instead of one data point per request. Requests are only counted together within a sync, so raise --cache-sync-interval and --cache-size for this to write fewer data points. The continuous queries created in this mode sum the field count instead of counting the field value. The server does not start if the existing continuous queries or tasks were created in the other mode",
+			},
+			cli.IntFlag{
+				Name:   FlagShutdownTimeout,
+				EnvVar: EnvShutdownTimeout,
+				Value:  20,
+				Usage:  "Specify how long the server waits on SIGTERM for in-flight requests to complete and pending data points to be written to database before exiting. In-flight requests get at most half of it, the rest is left to write the pending data points. Must be positive. Measured in second",
+			},
+			cli.StringFlag{
+				Name:   FlagSpoolDir,
+				EnvVar: EnvSpoolDir,
+				Usage:  "Specify the directory where requests are spooled until they are written to the database, so that they survive database outages and restarts. Requests are only kept in memory if not specified",
+			},
+			cli.IntFlag{
+				Name:   FlagSpoolMaxSize,
+				EnvVar: EnvSpoolMaxSize,
+				Value:  100,
+				Usage:  "Specify the maximum size of the spool. Measured in MiB",
+			},
+			cli.StringFlag{
+				Name:   FlagSpoolDropPolicy,
+				EnvVar: EnvSpoolDropPolicy,
+				Value:  upgraderesponder.SpoolDropOldest,
+				Usage:  fmt.Sprintf("Specify which requests are dropped once the spool is full. One of: %v, %v", upgraderesponder.SpoolDropOldest, upgraderesponder.SpoolDropNewest),
+			},
+			cli.IntFlag{
+				Name:   FlagConfigReloadInterval,
+				EnvVar: EnvConfigReloadInterval,
+				Value:  10,
+				Usage:  "Specify the period for how often the server should check the upgrade response configuration file for changes. Measured in second. Set to 0 to disable. The configuration can also be reloaded by sending SIGHUP to the server.",
+			},
 		},
 		Action: func(c *cli.Context) error {
 			return startUpgradeResponder(c)
@@ -132,42 +292,298 @@ func UpgradeResponderCmd() cli.Command {
 	}
 }
 
+func ValidateCmd() cli.Command {
+	return cli.Command{
+		Name:  "validate",
+		Usage: "Validate an upgrade response configuration file, reporting every error found",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:   FlagUpgradeResponseConfiguration,
+				EnvVar: EnvUpgradeResponseConfiguration,
+				Usage:  "Specify the response configuration file to validate",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			return validateUpgradeResponseConfig(c)
+		},
+	}
+}
+
+func validateUpgradeResponseConfig(c *cli.Context) error {
+	cfg := c.String(FlagUpgradeResponseConfiguration)
+	if cfg == "" {
+		return fmt.Errorf("no upgrade response configuration file specified")
+	}
+
+	errs := upgraderesponder.ValidateConfigFile(cfg)
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("found %d error(s) in %v", len(errs), cfg)
+	}
+	fmt.Printf("%v is valid\n", cfg)
+	return nil
+}
+
+func SimulateCmd() cli.Command {
+	return cli.Command{
+		Name:  "simulate",
+		Usage: "Show the response that clients would receive for an upgrade response configuration, and which rule it comes from",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:   FlagUpgradeResponseConfiguration,
+				EnvVar: EnvUpgradeResponseConfiguration,
+				Usage:  "Specify the response configuration file to simulate",
+			},
+			cli.StringFlag{
+				Name:  FlagSimulateAppVersion,
+				Usage: "Specify the appVersion of the simulated request",
+			},
+			cli.StringFlag{
+				Name:  FlagSimulatePlatform,
+				Usage: "Specify the platform of the simulated request in the form <platform>-<arch>, e.g. darwin-arm64",
+			},
+			cli.StringFlag{
+				Name:  FlagSimulatePlatformVersion,
+				Usage: "Specify the platformVersion of the simulated request",
+			},
+			cli.StringSliceFlag{
+				Name:  FlagSimulateExtraInfo,
+				Usage: "Specify an additional extraInfo entry of the simulated request in the form <key>=<value>. Can be repeated",
+			},
+			cli.StringFlag{
+				Name:  FlagSimulateRequests,
+				Usage: "Specify a file containing one JSON check upgrade request per line to simulate instead of a single request. Use - for stdin",
+			},
+			cli.StringFlag{
+				Name:  FlagSimulateTime,
+				Usage: "Specify the time at which the requests are simulated in RFC3339 format. Defaults to now",
+			},
+			cli.StringFlag{
+				Name:  FlagSimulateCountry,
+				Usage: "Specify the ISO code of the country the requests are simulated from, e.g. CA. The country is unknown by default",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			return simulateUpgradeResponse(c)
+		},
+	}
+}
+
+func simulateUpgradeResponse(c *cli.Context) error {
+	cfg := c.String(FlagUpgradeResponseConfiguration)
+	if cfg == "" {
+		return fmt.Errorf("no upgrade response configuration file specified")
+	}
+	config, err := rd.ReadConfig(cfg)
+	if err != nil {
+		return err
+	}
+	simulator, err := upgraderesponder.NewSimulator(config)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if rawTime := c.String(FlagSimulateTime); rawTime != "" {
+		if now, err = time.Parse(time.RFC3339, rawTime); err != nil {
+			return errors.Wrapf(err, "fail to parse --%v", FlagSimulateTime)
+		}
+	}
+
+	country := strings.ToUpper(c.String(FlagSimulateCountry))
+
+	requestsFile := c.String(FlagSimulateRequests)
+	if requestsFile == "" {
+		request, err := simulatedRequestFromFlags(c)
+		if err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(simulator.Simulate(request, country, now))
+	}
+
+	input := os.Stdin
+	if requestsFile != "-" {
+		f, err := os.Open(requestsFile)
+		if err != nil {
+			return errors.Wrapf(err, "fail to open %v", requestsFile)
+		}
+		defer f.Close()
+		input = f
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	scanner := bufio.NewScanner(input)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var request rd.CheckUpgradeRequest
+		if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+			return errors.Wrapf(err, "fail to parse request on line %v of %v", line, requestsFile)
+		}
+		if err := encoder.Encode(simulator.Simulate(request, country, now)); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func simulatedRequestFromFlags(c *cli.Context) (rd.CheckUpgradeRequest, error) {
+	request := rd.CheckUpgradeRequest{
+		AppVersion: c.String(FlagSimulateAppVersion),
+		ExtraInfo:  map[string]string{},
+	}
+	if request.AppVersion == "" {
+		return request, fmt.Errorf("either --%v or --%v must be specified", FlagSimulateAppVersion, FlagSimulateRequests)
+	}
+	for _, entry := range c.StringSlice(FlagSimulateExtraInfo) {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return request, fmt.Errorf("invalid --%v %q, must be in the form <key>=<value>", FlagSimulateExtraInfo, entry)
+		}
+		request.ExtraInfo[parts[0]] = parts[1]
+	}
+	if platform := c.String(FlagSimulatePlatform); platform != "" {
+		request.ExtraInfo["platform"] = platform
+	}
+	if platformVersion := c.String(FlagSimulatePlatformVersion); platformVersion != "" {
+		request.ExtraInfo["platformVersion"] = platformVersion
+	}
+	return request, nil
+}
+
+func AnalyzeCmd() cli.Command {
+	return cli.Command{
+		Name:  "analyze",
+		Usage: "Report rules of an upgrade response configuration that never apply because of an earlier rule, or that make every version unsupported",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:   FlagUpgradeResponseConfiguration,
+				EnvVar: EnvUpgradeResponseConfiguration,
+				Usage:  "Specify the response configuration file to analyze",
+			},
+			cli.BoolFlag{
+				Name:  FlagFailOnWarnings,
+				Usage: "Exit with an error if any warning is reported",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			return analyzeUpgradeResponseConfig(c)
+		},
+	}
+}
+
+func analyzeUpgradeResponseConfig(c *cli.Context) error {
+	cfg := c.String(FlagUpgradeResponseConfiguration)
+	if cfg == "" {
+		return fmt.Errorf("no upgrade response configuration file specified")
+	}
+	config, err := rd.ReadConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	warnings := config.AnalyzeRules()
+	for _, warning := range warnings {
+		fmt.Println(warning)
+	}
+	if len(warnings) > 0 && c.Bool(FlagFailOnWarnings) {
+		return fmt.Errorf("found %d warning(s) in %v", len(warnings), cfg)
+	}
+	return nil
+}
+
 func startUpgradeResponder(c *cli.Context) error {
 	if err := validateCommandLineArguments(c); err != nil {
 		return err
 	}
 
-	cfg := c.String(FlagUpgradeResponseConfiguration)
-	influxURL := c.String(FlagInfluxDBURL)
-	influxUser := c.String(FlagInfluxDBUser)
-	influxPass := c.String(FlagInfluxDBPass)
-	queryPeriod := c.String(FlagQueryPeriod)
-	applicationName := c.String(FlagApplicationName)
-	geodb := c.String(FlagGeoDB)
+	options := upgraderesponder.ServerOptions{
+		ApplicationName:      c.String(FlagApplicationName),
+		ConfigFile:           c.String(FlagUpgradeResponseConfiguration),
+		ConfigReloadInterval: time.Duration(c.Int(FlagConfigReloadInterval)) * time.Second,
+		QueryPeriod:          c.String(FlagQueryPeriod),
+		GeoResolver:          c.String(FlagGeoResolver),
+		GeoDB:                c.String(FlagGeoDB),
+		GeoCSV:               c.String(FlagGeoCSV),
+		ASNDB:                c.String(FlagASNDB),
+		GeoDBReloadInterval:  time.Duration(c.Int(FlagGeoDBReloadInterval)) * time.Second,
+		TrustedProxies:       strings.Split(c.String(FlagTrustedProxies), ","),
+		CacheSyncInterval:    time.Duration(c.Int(FlagCacheSyncInterval)) * time.Second,
+		CacheSize:            c.Int(FlagCacheSize),
+		CacheQueueSize:       c.Int(FlagCacheQueueSize),
+		AggregateRequests:    c.Bool(FlagAggregateRequests),
+		MetricsBackend:       c.String(FlagMetricsBackend),
+		InfluxDB: upgraderesponder.InfluxDBOptions{
+			URL:  c.String(FlagInfluxDBURL),
+			User: c.String(FlagInfluxDBUser),
+			Pass: c.String(FlagInfluxDBPass),
+
+			Org:       c.String(FlagInfluxDBOrg),
+			Bucket:    c.String(FlagInfluxDBBucket),
+			Token:     c.String(FlagInfluxDBToken),
+			SkipSetup: c.Bool(FlagInfluxDBSkipSetup),
+		},
+		Spool: upgraderesponder.SpoolOptions{
+			Dir:        c.String(FlagSpoolDir),
+			MaxBytes:   int64(c.Int(FlagSpoolMaxSize)) * 1024 * 1024,
+			DropPolicy: c.String(FlagSpoolDropPolicy),
+		},
+		LocalStorage: upgraderesponder.LocalStorageOptions{
+			Dir:       c.String(FlagLocalStorageDir),
+			Retention: time.Duration(c.Int(FlagLocalStorageRetention)) * 24 * time.Hour,
+		},
+	}
 	port := c.Int(FlagPort)
-	cacheSyncInterval := c.Int(FlagCacheSyncInterval)
-	cacheSize := c.Int(FlagCacheSize)
 
 	done := make(chan struct{})
-	server, err := upgraderesponder.NewServer(done, applicationName, cfg, influxURL, influxUser, influxPass, queryPeriod, geodb, cacheSyncInterval, cacheSize)
+	server, err := upgraderesponder.NewServer(done, options)
 	if err != nil {
 		return err
 	}
 	router := http.Handler(upgraderesponder.NewRouter(server))
 
 	listeningAddress := fmt.Sprintf("0.0.0.0:%v", port)
+	httpServer := &http.Server{
+		Addr:    listeningAddress,
+		Handler: router,
+	}
 
+	serveErr := make(chan error, 1)
 	go func() {
 		logrus.Infof("Server is listening at %v", listeningAddress)
 		// always returns error. ErrServerClosed on graceful close
-		if err := http.ListenAndServe(listeningAddress, router); err != http.ErrServerClosed {
-			logrus.Fatalf("%v", err)
-		}
-		<-done
+		serveErr <- httpServer.ListenAndServe()
 	}()
 
 	RegisterShutdownChannel(done)
-	<-done
+	RegisterReloadSignal(done, server)
+	select {
+	case err := <-serveErr:
+		return errors.Wrap(err, "fail to serve")
+	case <-done:
+	}
+
+	// Stop accepting requests and wait for the ones in flight, so that
+	// they are all recorded before the pending requests are written. Slow
+	// clients may only use up half of the timeout, so that the pending
+	// requests always get the other half, plus whatever the clients left.
+	timeout := time.Duration(c.Int(FlagShutdownTimeout)) * time.Second
+	deadline := time.Now().Add(timeout)
+	httpCtx, httpCancel := context.WithTimeout(context.Background(), timeout/2)
+	defer httpCancel()
+	if err := httpServer.Shutdown(httpCtx); err != nil {
+		logrus.Errorf("Failed to wait for in-flight requests: %v", err)
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		return err
+	}
+	logrus.Infof("Server stopped")
 	return nil
 }
 
@@ -181,6 +597,29 @@ func RegisterShutdownChannel(done chan struct{}) {
 	}()
 }
 
+// RegisterReloadSignal reloads the upgrade response configuration of server
+// every time SIGHUP is received, until done is closed.
+func RegisterReloadSignal(done chan struct{}, server *upgraderesponder.Server) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(sigs)
+		for {
+			select {
+			case sig := <-sigs:
+				logrus.Infof("Receive %v to reload the upgrade response configuration", sig)
+				if err := server.ReloadConfig(); err != nil {
+					logrus.Errorf("Failed to reload config, keeping the previous one: %v", err)
+				} else {
+					logrus.Infof("Upgrade response configuration reloaded")
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
 func validateCommandLineArguments(c *cli.Context) error {
 	cfg := c.String(FlagUpgradeResponseConfiguration)
 	if cfg == "" {
@@ -197,5 +636,21 @@ func validateCommandLineArguments(c *cli.Context) error {
 		return errors.Wrap(err, "fail to parse --query-period")
 	}
 
+	if c.Int(FlagConfigReloadInterval) < 0 {
+		return fmt.Errorf("--%v cannot be negative", FlagConfigReloadInterval)
+	}
+	if c.Int(FlagGeoDBReloadInterval) < 0 {
+		return fmt.Errorf("--%v cannot be negative", FlagGeoDBReloadInterval)
+	}
+
+	// A zero timeout would leave no time to write the pending data points.
+	if c.Int(FlagShutdownTimeout) <= 0 {
+		return fmt.Errorf("--%v must be positive", FlagShutdownTimeout)
+	}
+
+	if c.Int(FlagLocalStorageRetention) < 0 {
+		return fmt.Errorf("--%v cannot be negative", FlagLocalStorageRetention)
+	}
+
 	return nil
 }
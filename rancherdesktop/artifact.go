@@ -0,0 +1,80 @@
+package rancherdesktop
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+)
+
+// maxSummaryLength is the maximum number of characters in Version.Summary.
+const maxSummaryLength = 280
+
+var sha256Regex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// Artifact is a file that installs a Version on one platform and arch.
+type Artifact struct {
+	Platform string
+	Arch     string
+	// Must be an absolute http or https URL.
+	URL string
+	// Size of the file in bytes, if known.
+	Size int64 `json:",omitempty"`
+	// Lowercase hex-encoded SHA-256 checksum of the file, if known.
+	SHA256 string `json:",omitempty"`
+	// URL of a detached signature of the file, if any.
+	SignatureURL string `json:",omitempty"`
+}
+
+// validate returns the problem found in an Artifact, if any.
+func (artifact Artifact) validate() error {
+	if !validPlatform[artifact.Platform] {
+		return fmt.Errorf("invalid Platform %q", artifact.Platform)
+	}
+	if !validArch[artifact.Arch] {
+		return fmt.Errorf("invalid Arch %q", artifact.Arch)
+	}
+	if err := validateURL(artifact.URL); err != nil {
+		return fmt.Errorf("invalid URL: %w", err)
+	}
+	if artifact.Size < 0 {
+		return fmt.Errorf("invalid Size %d: must not be negative", artifact.Size)
+	}
+	if artifact.SHA256 != "" && !sha256Regex.MatchString(artifact.SHA256) {
+		return fmt.Errorf("invalid SHA256 %q: must be 64 lowercase hex digits", artifact.SHA256)
+	}
+	if artifact.SignatureURL != "" {
+		if err := validateURL(artifact.SignatureURL); err != nil {
+			return fmt.Errorf("invalid SignatureURL: %w", err)
+		}
+	}
+	return nil
+}
+
+// validateURL returns an error if rawURL is not an absolute http or https
+// URL.
+func validateURL(rawURL string) error {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if parsedURL.Scheme != "http" && parsedURL.Scheme != "https" {
+		return fmt.Errorf("%q must be an http or https URL", rawURL)
+	}
+	if parsedURL.Host == "" {
+		return errors.New("URL must have a host")
+	}
+	return nil
+}
+
+// ArtifactsFor returns the Artifacts of a Version for the given platform
+// and arch.
+func (version Version) ArtifactsFor(platform, arch string) []Artifact {
+	var result []Artifact
+	for _, artifact := range version.Artifacts {
+		if artifact.Platform == platform && artifact.Arch == arch {
+			result = append(result, artifact)
+		}
+	}
+	return result
+}
@@ -0,0 +1,68 @@
+package rancherdesktop
+
+import (
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// ExtraInfoKeyChannel is the key in CheckUpgradeRequest.ExtraInfo under
+// which a client sends the release channel it follows.
+const ExtraInfoKeyChannel = "channel"
+
+const (
+	ChannelStable  = "stable"
+	ChannelBeta    = "beta"
+	ChannelNightly = "nightly"
+)
+
+// channelRanks orders the release channels from the most stable. A client
+// following a channel is offered the Versions of that channel and of the
+// more stable ones.
+var channelRanks = map[string]int{
+	ChannelStable:  0,
+	ChannelBeta:    1,
+	ChannelNightly: 2,
+}
+
+// ClientChannel returns the release channel followed by the client that
+// made request. Clients that do not send a known channel, such as older
+// versions of Rancher Desktop, follow the stable channel.
+func ClientChannel(request CheckUpgradeRequest) string {
+	channel := strings.ToLower(request.ExtraInfo[ExtraInfoKeyChannel])
+	if _, ok := channelRanks[channel]; !ok {
+		return ChannelStable
+	}
+	return channel
+}
+
+// ReleaseChannels returns the release channels of a Version: its Channels
+// if specified, and otherwise a channel derived from its Name. A Name
+// without a pre-release is stable. A pre-release whose first identifier is
+// a channel, such as 1.10.0-nightly.20230501, is in that channel, and any
+// other pre-release, such as 1.10.0-rc.1, is beta.
+func (version Version) ReleaseChannels() []string {
+	if len(version.Channels) > 0 {
+		return version.Channels
+	}
+	parsedVersion, err := semver.NewVersion(version.Name)
+	if err != nil || parsedVersion.Prerelease() == "" {
+		return []string{ChannelStable}
+	}
+	identifier := strings.ToLower(strings.SplitN(parsedVersion.Prerelease(), ".", 2)[0])
+	if _, ok := channelRanks[identifier]; ok {
+		return []string{identifier}
+	}
+	return []string{ChannelBeta}
+}
+
+// OfferedOn returns true if a Version is offered to the clients that
+// follow channel, which must be a known channel.
+func (version Version) OfferedOn(channel string) bool {
+	for _, versionChannel := range version.ReleaseChannels() {
+		if rank, ok := channelRanks[versionChannel]; ok && rank <= channelRanks[channel] {
+			return true
+		}
+	}
+	return false
+}
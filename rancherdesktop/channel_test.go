@@ -0,0 +1,66 @@
+package rancherdesktop
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestChannel(t *testing.T) {
+	t.Run("ClientChannel", func(t *testing.T) {
+		testCases := []struct {
+			ExtraInfo       map[string]string
+			ExpectedChannel string
+		}{
+			{ExtraInfo: nil, ExpectedChannel: ChannelStable},
+			{ExtraInfo: map[string]string{"channel": "beta"}, ExpectedChannel: ChannelBeta},
+			{ExtraInfo: map[string]string{"channel": "Nightly"}, ExpectedChannel: ChannelNightly},
+			{ExtraInfo: map[string]string{"channel": "canary"}, ExpectedChannel: ChannelStable},
+		}
+		for _, testCase := range testCases {
+			channel := ClientChannel(CheckUpgradeRequest{AppVersion: "1.2.3", ExtraInfo: testCase.ExtraInfo})
+			if channel != testCase.ExpectedChannel {
+				t.Errorf("expected channel %q for %v but got %q", testCase.ExpectedChannel, testCase.ExtraInfo, channel)
+			}
+		}
+	})
+
+	t.Run(".ReleaseChannels", func(t *testing.T) {
+		testCases := []struct {
+			Version          Version
+			ExpectedChannels []string
+		}{
+			{Version: Version{Name: "1.10.0"}, ExpectedChannels: []string{ChannelStable}},
+			{Version: Version{Name: "1.10.0-rc.1"}, ExpectedChannels: []string{ChannelBeta}},
+			{Version: Version{Name: "1.10.0-beta.2"}, ExpectedChannels: []string{ChannelBeta}},
+			{Version: Version{Name: "1.10.0-nightly.20230501"}, ExpectedChannels: []string{ChannelNightly}},
+			{Version: Version{Name: "1.10.0", Channels: []string{ChannelBeta, ChannelNightly}}, ExpectedChannels: []string{ChannelBeta, ChannelNightly}},
+		}
+		for _, testCase := range testCases {
+			channels := testCase.Version.ReleaseChannels()
+			if strings.Join(channels, ",") != strings.Join(testCase.ExpectedChannels, ",") {
+				t.Errorf("expected channels %v for %#v but got %v", testCase.ExpectedChannels, testCase.Version, channels)
+			}
+		}
+	})
+
+	t.Run(".OfferedOn", func(t *testing.T) {
+		testCases := []struct {
+			Version  Version
+			Channel  string
+			Expected bool
+		}{
+			{Version: Version{Name: "1.10.0"}, Channel: ChannelStable, Expected: true},
+			{Version: Version{Name: "1.10.0"}, Channel: ChannelNightly, Expected: true},
+			{Version: Version{Name: "1.10.0-rc.1"}, Channel: ChannelStable, Expected: false},
+			{Version: Version{Name: "1.10.0-rc.1"}, Channel: ChannelBeta, Expected: true},
+			{Version: Version{Name: "1.10.0-nightly.1"}, Channel: ChannelBeta, Expected: false},
+			{Version: Version{Name: "1.10.0-nightly.1"}, Channel: ChannelNightly, Expected: true},
+			{Version: Version{Name: "1.10.0", Channels: []string{ChannelBeta}}, Channel: ChannelStable, Expected: false},
+		}
+		for _, testCase := range testCases {
+			if result := testCase.Version.OfferedOn(testCase.Channel); result != testCase.Expected {
+				t.Errorf("expected %t for %q on %q but got %t", testCase.Expected, testCase.Version.Name, testCase.Channel, result)
+			}
+		}
+	})
+}
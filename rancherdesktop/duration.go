@@ -0,0 +1,24 @@
+package rancherdesktop
+
+import (
+	"time"
+)
+
+// Duration is a time.Duration that is represented in JSON as a string in
+// the format accepted by time.ParseDuration, for example "72h".
+type Duration struct {
+	time.Duration
+}
+
+func (duration *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	duration.Duration = parsed
+	return nil
+}
+
+func (duration Duration) MarshalText() ([]byte, error) {
+	return []byte(duration.String()), nil
+}
@@ -0,0 +1,109 @@
+package rancherdesktop
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// Regexp is a regular expression that is represented in JSON as a string
+// in the syntax accepted by regexp.Compile.
+type Regexp struct {
+	*regexp.Regexp
+}
+
+func (re *Regexp) UnmarshalText(text []byte) error {
+	compiled, err := regexp.Compile(string(text))
+	if err != nil {
+		return err
+	}
+	re.Regexp = compiled
+	return nil
+}
+
+func (re Regexp) MarshalText() ([]byte, error) {
+	if re.Regexp == nil {
+		return nil, nil
+	}
+	return []byte(re.String()), nil
+}
+
+// ExtraInfoMatcher is a condition on the value of a key of the ExtraInfo
+// sent by a client. Exactly one of its fields must be set. A client that
+// does not send the key never matches.
+type ExtraInfoMatcher struct {
+	// Matches a value equal to Equals.
+	Equals *string `json:",omitempty"`
+	// Matches a value equal to one of In.
+	In []string `json:",omitempty"`
+	// Matches a value that Regex matches. Use ^ and $ to match the whole
+	// value.
+	Regex *Regexp `json:",omitempty"`
+	// Matches a value that is a version satisfying Semver.
+	Semver *semver.Constraints `json:",omitempty"`
+}
+
+// validate returns the problem found in an ExtraInfoMatcher, if any.
+func (matcher ExtraInfoMatcher) validate() error {
+	count := 0
+	if matcher.Equals != nil {
+		count++
+	}
+	if matcher.In != nil {
+		if len(matcher.In) == 0 {
+			return errors.New("In must not be empty")
+		}
+		count++
+	}
+	if matcher.Regex != nil {
+		count++
+	}
+	if matcher.Semver != nil {
+		count++
+	}
+	if count != 1 {
+		return fmt.Errorf("exactly one of Equals, In, Regex and Semver must be specified, got %d", count)
+	}
+	return nil
+}
+
+// Matches returns true if value satisfies the matcher.
+func (matcher ExtraInfoMatcher) Matches(value string) bool {
+	switch {
+	case matcher.Equals != nil:
+		return value == *matcher.Equals
+	case matcher.In != nil:
+		return containsString(matcher.In, value)
+	case matcher.Regex != nil:
+		return matcher.Regex.MatchString(value)
+	case matcher.Semver != nil:
+		version, err := semver.NewVersion(value)
+		return err == nil && matcher.Semver.Check(version)
+	}
+	return false
+}
+
+// covers returns true if every value that other matches is also matched
+// by matcher. Like Criteria.covers, a false result only means that it
+// could not be shown.
+func (matcher ExtraInfoMatcher) covers(other ExtraInfoMatcher) bool {
+	var values []string
+	switch {
+	case other.Equals != nil:
+		values = []string{*other.Equals}
+	case other.In != nil:
+		values = other.In
+	case other.Regex != nil:
+		return matcher.Regex != nil && matcher.Regex.String() == other.Regex.String()
+	case other.Semver != nil:
+		return matcher.Semver != nil && constraintsCover(matcher.Semver, other.Semver)
+	}
+	for _, value := range values {
+		if !matcher.Matches(value) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,105 @@
+package rancherdesktop
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func newExtraInfoMatcher(t *testing.T, rawJSON string) ExtraInfoMatcher {
+	var matcher ExtraInfoMatcher
+	if err := json.Unmarshal([]byte(rawJSON), &matcher); err != nil {
+		t.Fatalf("failed to parse matcher %s: %s", rawJSON, err)
+	}
+	return matcher
+}
+
+func TestExtraInfoMatcher(t *testing.T) {
+	t.Run(".Matches", func(t *testing.T) {
+		testCases := []struct {
+			Matcher  string
+			Value    string
+			Expected bool
+		}{
+			{Matcher: `{"Equals": "moby"}`, Value: "moby", Expected: true},
+			{Matcher: `{"Equals": "moby"}`, Value: "containerd", Expected: false},
+			{Matcher: `{"Equals": ""}`, Value: "", Expected: true},
+			{Matcher: `{"In": ["moby", "containerd"]}`, Value: "containerd", Expected: true},
+			{Matcher: `{"In": ["moby"]}`, Value: "containerd", Expected: false},
+			{Matcher: `{"Regex": "^wsl-"}`, Value: "wsl-ubuntu", Expected: true},
+			{Matcher: `{"Regex": "^wsl-"}`, Value: "hyperv", Expected: false},
+			{Matcher: `{"Semver": "<1.24"}`, Value: "1.23.9", Expected: true},
+			{Matcher: `{"Semver": "<1.24"}`, Value: "v1.25.0", Expected: false},
+			{Matcher: `{"Semver": "<1.24"}`, Value: "not-a-version", Expected: false},
+		}
+		for _, testCase := range testCases {
+			matcher := newExtraInfoMatcher(t, testCase.Matcher)
+			if result := matcher.Matches(testCase.Value); result != testCase.Expected {
+				t.Errorf("expected %t for %s matching %q but got %t", testCase.Expected, testCase.Matcher, testCase.Value, result)
+			}
+		}
+	})
+
+	t.Run("should fail to parse an invalid regex", func(t *testing.T) {
+		var matcher ExtraInfoMatcher
+		if err := json.Unmarshal([]byte(`{"Regex": "("}`), &matcher); err == nil {
+			t.Errorf("expected error")
+		}
+	})
+
+	t.Run(".validate", func(t *testing.T) {
+		testCases := []struct {
+			Description   string
+			Matcher       string
+			ExpectedError string
+		}{
+			{
+				Description:   "should return error if no operator is specified",
+				Matcher:       `{}`,
+				ExpectedError: "exactly one of Equals, In, Regex and Semver must be specified, got 0",
+			},
+			{
+				Description:   "should return error if several operators are specified",
+				Matcher:       `{"Equals": "moby", "Regex": "^moby$"}`,
+				ExpectedError: "exactly one of Equals, In, Regex and Semver must be specified, got 2",
+			},
+			{
+				Description:   "should return error if In is empty",
+				Matcher:       `{"In": []}`,
+				ExpectedError: "In must not be empty",
+			},
+		}
+		for _, testCase := range testCases {
+			t.Run(testCase.Description, func(t *testing.T) {
+				err := newExtraInfoMatcher(t, testCase.Matcher).validate()
+				if err == nil {
+					t.Errorf("no error produced while validating invalid matcher %s", testCase.Matcher)
+				} else if !strings.Contains(err.Error(), testCase.ExpectedError) {
+					t.Errorf("error %q does not contain %q", err, testCase.ExpectedError)
+				}
+			})
+		}
+	})
+
+	t.Run(".covers", func(t *testing.T) {
+		testCases := []struct {
+			Matcher  string
+			Other    string
+			Expected bool
+		}{
+			{Matcher: `{"In": ["moby", "containerd"]}`, Other: `{"Equals": "moby"}`, Expected: true},
+			{Matcher: `{"Equals": "moby"}`, Other: `{"In": ["moby", "containerd"]}`, Expected: false},
+			{Matcher: `{"Regex": "^mo"}`, Other: `{"In": ["moby", "mock"]}`, Expected: true},
+			{Matcher: `{"Regex": "^mo"}`, Other: `{"Regex": "^mob"}`, Expected: false},
+			{Matcher: `{"Semver": "<1.24"}`, Other: `{"Semver": "1.22.x"}`, Expected: true},
+			{Matcher: `{"Semver": "<1.24"}`, Other: `{"In": ["1.25.0"]}`, Expected: false},
+		}
+		for _, testCase := range testCases {
+			matcher := newExtraInfoMatcher(t, testCase.Matcher)
+			other := newExtraInfoMatcher(t, testCase.Other)
+			if result := matcher.covers(other); result != testCase.Expected {
+				t.Errorf("expected %t for %s covering %s but got %t", testCase.Expected, testCase.Matcher, testCase.Other, result)
+			}
+		}
+	})
+}
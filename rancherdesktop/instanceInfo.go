@@ -32,6 +32,12 @@ type InstanceInfo struct {
 	Platform        string
 	Arch            string
 	PlatformVersion *semver.Version
+	// The ISO 3166-1 alpha-2 code of the country the request came from, or
+	// an empty string if it is unknown. It is not part of the request, so
+	// it is set by the server once the location of the client is resolved.
+	Country string
+	// The ExtraInfo of the request, used to match Criteria.ExtraInfo.
+	ExtraInfo map[string]string
 }
 
 // NewInstanceInfo converts the general CheckUpgradeRequest type into an InstanceInfo.
@@ -43,23 +49,9 @@ func NewInstanceInfo(checkUpgradeRequest CheckUpgradeRequest) (InstanceInfo, err
 		return InstanceInfo{}, fmt.Errorf("failed to parse AppVersion as semver: %w", err)
 	}
 
-	platformAndArch, ok := checkUpgradeRequest.ExtraInfo["platform"]
-	if !ok {
-		return InstanceInfo{}, errors.New("extraInfo.platform not present")
-	}
-	components := strings.Split(platformAndArch, "-")
-	if len(components) != 2 {
-		return InstanceInfo{}, fmt.Errorf("invalid extraInfo.platform %q", platformAndArch)
-	}
-
-	platform := components[0]
-	if !validPlatform[platform] {
-		return InstanceInfo{}, fmt.Errorf("invalid platform %q", platform)
-	}
-
-	arch := components[1]
-	if !validArch[arch] {
-		return InstanceInfo{}, fmt.Errorf("invalid arch %q", arch)
+	platform, arch, err := ParsePlatform(checkUpgradeRequest)
+	if err != nil {
+		return InstanceInfo{}, err
 	}
 
 	rawPlatformVersion, ok := checkUpgradeRequest.ExtraInfo["platformVersion"]
@@ -77,5 +69,30 @@ func NewInstanceInfo(checkUpgradeRequest CheckUpgradeRequest) (InstanceInfo, err
 		Platform:        platform,
 		Arch:            arch,
 		PlatformVersion: platformVersion,
+		ExtraInfo:       checkUpgradeRequest.ExtraInfo,
 	}, nil
 }
+
+// ParsePlatform returns the platform and the architecture sent by a client
+// in extraInfo.platform, in the form <platform>-<arch>.
+func ParsePlatform(checkUpgradeRequest CheckUpgradeRequest) (platform, arch string, err error) {
+	platformAndArch, ok := checkUpgradeRequest.ExtraInfo["platform"]
+	if !ok {
+		return "", "", errors.New("extraInfo.platform not present")
+	}
+	components := strings.Split(platformAndArch, "-")
+	if len(components) != 2 {
+		return "", "", fmt.Errorf("invalid extraInfo.platform %q", platformAndArch)
+	}
+
+	platform = components[0]
+	if !validPlatform[platform] {
+		return "", "", fmt.Errorf("invalid platform %q", platform)
+	}
+
+	arch = components[1]
+	if !validArch[arch] {
+		return "", "", fmt.Errorf("invalid arch %q", arch)
+	}
+	return platform, arch, nil
+}
@@ -0,0 +1,61 @@
+package rancherdesktop
+
+import (
+	"github.com/Masterminds/semver/v3"
+)
+
+// Recommended returns the Name of the Version of versions, the Versions
+// offered to a client running appVersion on channel, that the client
+// should upgrade to, or an empty string if there is none. Only the
+// supported, non-retracted Versions newer than appVersion are considered.
+//
+// The client cannot upgrade past the oldest SteppingStone of its channel
+// newer than appVersion. It is looked up in configVersions, every Version
+// of the config, since it must be taken into account even if it is not
+// offered to the client yet, for example because of its Rollout. The
+// newest Version up to that SteppingStone is recommended.
+func Recommended(appVersion *semver.Version, channel string, versions, configVersions []Version) string {
+	steppingStone := nextSteppingStone(appVersion, channel, configVersions)
+	var (
+		newest     *semver.Version
+		newestName string
+	)
+	for _, version := range versions {
+		if !version.Supported || version.Retracted != nil {
+			continue
+		}
+		parsedVersion, err := semver.NewVersion(version.Name)
+		if err != nil || !parsedVersion.GreaterThan(appVersion) {
+			continue
+		}
+		if steppingStone != nil && parsedVersion.GreaterThan(steppingStone) {
+			continue
+		}
+		if newest == nil || parsedVersion.GreaterThan(newest) {
+			newest = parsedVersion
+			newestName = version.Name
+		}
+	}
+	return newestName
+}
+
+// nextSteppingStone returns the oldest SteppingStone of versions that is
+// offered on channel and newer than appVersion, or nil if there is none.
+// The SteppingStones of less stable channels do not apply to the clients
+// of channel, which never upgrade to them.
+func nextSteppingStone(appVersion *semver.Version, channel string, versions []Version) *semver.Version {
+	var steppingStone *semver.Version
+	for _, version := range versions {
+		if !version.SteppingStone || version.Retracted != nil || !version.OfferedOn(channel) {
+			continue
+		}
+		parsedVersion, err := semver.NewVersion(version.Name)
+		if err != nil || !parsedVersion.GreaterThan(appVersion) {
+			continue
+		}
+		if steppingStone == nil || parsedVersion.LessThan(steppingStone) {
+			steppingStone = parsedVersion
+		}
+	}
+	return steppingStone
+}
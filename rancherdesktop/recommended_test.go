@@ -0,0 +1,139 @@
+package rancherdesktop
+
+import (
+	"testing"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+func TestRecommended(t *testing.T) {
+	testCases := []struct {
+		Description string
+		AppVersion  string
+		// The channel of the client, if not stable.
+		Channel  string
+		Versions []Version
+		// The Versions of the config that are not offered to the client.
+		NotOffered []Version
+		Expected   string
+	}{
+		{
+			Description: "should recommend the newest supported version",
+			AppVersion:  "1.8.0",
+			Versions: []Version{
+				{Name: "1.10.0", Supported: true},
+				{Name: "1.9.1", Supported: true},
+				{Name: "1.11.0", Supported: false},
+			},
+			Expected: "1.10.0",
+		},
+		{
+			Description: "should not recommend retracted versions",
+			AppVersion:  "1.8.0",
+			Versions: []Version{
+				{Name: "1.9.1", Supported: true},
+				{Name: "1.10.0", Supported: true, Retracted: &Retraction{Reason: "broken"}},
+			},
+			Expected: "1.9.1",
+		},
+		{
+			Description: "should recommend nothing if no version is newer than the client",
+			AppVersion:  "1.10.0",
+			Versions: []Version{
+				{Name: "1.9.1", Supported: true},
+				{Name: "1.10.0", Supported: true},
+			},
+			Expected: "",
+		},
+		{
+			Description: "should recommend the oldest newer stepping stone",
+			AppVersion:  "1.8.0",
+			Versions: []Version{
+				{Name: "1.11.0", Supported: true},
+				{Name: "1.10.0", Supported: true, SteppingStone: true},
+				{Name: "1.9.0", Supported: true, SteppingStone: true},
+				{Name: "1.7.0", Supported: true, SteppingStone: true},
+			},
+			Expected: "1.9.0",
+		},
+		{
+			Description: "should ignore stepping stones the client has passed",
+			AppVersion:  "1.10.0",
+			Versions: []Version{
+				{Name: "1.11.0", Supported: true},
+				{Name: "1.10.0", Supported: true, SteppingStone: true},
+			},
+			Expected: "1.11.0",
+		},
+		{
+			Description: "should recommend the newest version older than a stepping stone that is not offered",
+			AppVersion:  "1.8.0",
+			Versions: []Version{
+				{Name: "1.11.0", Supported: true},
+				{Name: "1.9.1", Supported: true},
+			},
+			NotOffered: []Version{
+				{Name: "1.10.0", SteppingStone: true},
+			},
+			Expected: "1.9.1",
+		},
+		{
+			Description: "should recommend the newest version older than an unsupported stepping stone",
+			AppVersion:  "1.8.0",
+			Versions: []Version{
+				{Name: "1.11.0", Supported: true},
+				{Name: "1.10.0", Supported: false, SteppingStone: true},
+				{Name: "1.9.1", Supported: true},
+			},
+			Expected: "1.9.1",
+		},
+		{
+			Description: "should recommend nothing if the next stepping stone is not offered",
+			AppVersion:  "1.9.1",
+			Versions: []Version{
+				{Name: "1.11.0", Supported: true},
+			},
+			NotOffered: []Version{
+				{Name: "1.10.0", SteppingStone: true},
+			},
+			Expected: "",
+		},
+		{
+			Description: "should ignore the stepping stones of less stable channels",
+			AppVersion:  "1.9.1",
+			Versions: []Version{
+				{Name: "1.10.0", Supported: true},
+			},
+			NotOffered: []Version{
+				{Name: "1.10.0-nightly.1", SteppingStone: true},
+			},
+			Expected: "1.10.0",
+		},
+		{
+			Description: "should honour the stepping stones of the channel of the client",
+			AppVersion:  "1.9.1",
+			Channel:     ChannelBeta,
+			Versions: []Version{
+				{Name: "1.10.0", Supported: true},
+				{Name: "1.9.2", Supported: true},
+			},
+			NotOffered: []Version{
+				{Name: "1.10.0-rc.1", SteppingStone: true},
+			},
+			Expected: "1.9.2",
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.Description, func(t *testing.T) {
+			channel := testCase.Channel
+			if channel == "" {
+				channel = ChannelStable
+			}
+			configVersions := append(append([]Version{}, testCase.Versions...), testCase.NotOffered...)
+			result := Recommended(semver.MustParse(testCase.AppVersion), channel, testCase.Versions, configVersions)
+			if result != testCase.Expected {
+				t.Errorf("expected %q but got %q", testCase.Expected, result)
+			}
+		})
+	}
+}
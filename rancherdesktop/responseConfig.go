@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+
+	"github.com/Masterminds/semver/v3"
 )
 
 const VersionTagLatest = "latest"
@@ -14,41 +16,139 @@ const VersionTagLatest = "latest"
 type ResponseConfig struct {
 	Rules    []Rule
 	Versions []Version
+	// Clients running a version older than MinimumSupportedVersion are told
+	// that their version is end-of-life. Must be a valid semver if set.
+	MinimumSupportedVersion string `json:",omitempty"`
+}
+
+// ConfigError is a problem found in a ResponseConfig. Path is the JSON path
+// of the value that the problem was found in.
+type ConfigError struct {
+	Path string
+	Err  error
 }
 
+func (configError *ConfigError) Error() string {
+	return fmt.Sprintf("%s: %s", configError.Path, configError.Err)
+}
+
+func (configError *ConfigError) Unwrap() error {
+	return configError.Err
+}
+
+// Validate returns the first problem found in a ResponseConfig, if any.
 func (responseConfig *ResponseConfig) Validate() error {
+	if errs := responseConfig.ValidationErrors(); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// ValidationErrors returns every problem found in a ResponseConfig.
+func (responseConfig *ResponseConfig) ValidationErrors() []*ConfigError {
+	var configErrors []*ConfigError
+	addError := func(path string, err error) {
+		configErrors = append(configErrors, &ConfigError{Path: path, Err: err})
+	}
+
 	// validate Rules
-	for _, rule := range responseConfig.Rules {
-		if err := rule.Validate(); err != nil {
-			return fmt.Errorf("invalid rule %v: %w", rule, err)
+	for i, rule := range responseConfig.Rules {
+		for _, err := range rule.validate() {
+			addError(fmt.Sprintf("$.Rules[%d]", i), fmt.Errorf("invalid rule: %w", err))
 		}
 	}
 
 	// validate Versions
 	versionMap := map[string]Version{}
 	tagVersionsMap := map[string][]Version{}
-	for _, version := range responseConfig.Versions {
-		if err := version.Validate(); err != nil {
-			return fmt.Errorf("invalid version %q: %w", version.Name, err)
+	for i, version := range responseConfig.Versions {
+		path := fmt.Sprintf("$.Versions[%d]", i)
+		for _, err := range version.validate() {
+			addError(path, fmt.Errorf("invalid version %q: %w", version.Name, err))
 		}
 		if _, ok := versionMap[version.Name]; ok {
-			return fmt.Errorf("duplicate version name %q", version.Name)
+			addError(path, fmt.Errorf("duplicate version name %q", version.Name))
 		}
 		for _, tag := range version.Tags {
 			tagVersionsMap[tag] = append(tagVersionsMap[tag], version)
 		}
+		// Older versions of Rancher Desktop upgrade to the version tagged
+		// latest, so it must be offered to every client.
+		if version.Rollout != nil && hasTag(version, VersionTagLatest) {
+			addError(path, fmt.Errorf("version %q tagged %s cannot have a Rollout", version.Name, VersionTagLatest))
+		}
+		// Older versions of Rancher Desktop do not send a channel, so they
+		// follow the stable channel.
+		if hasTag(version, VersionTagLatest) && !version.OfferedOn(ChannelStable) {
+			addError(path, fmt.Errorf("version %q tagged %s must be on the %s channel", version.Name, VersionTagLatest, ChannelStable))
+		}
 		versionMap[version.Name] = version
 	}
+	for i, version := range responseConfig.Versions {
+		if version.Retracted == nil {
+			continue
+		}
+		path := fmt.Sprintf("$.Versions[%d].Retracted", i)
+		// Older versions of Rancher Desktop upgrade to the version tagged
+		// latest regardless of whether it is retracted.
+		if hasTag(version, VersionTagLatest) {
+			addError(path, fmt.Errorf("version %q tagged %s cannot be retracted", version.Name, VersionTagLatest))
+		}
+		if replacement := version.Retracted.Replacement; replacement != "" {
+			if replacementVersion, ok := versionMap[replacement]; !ok {
+				addError(path, fmt.Errorf("unknown Replacement %q", replacement))
+			} else if replacementVersion.Retracted != nil {
+				addError(path, fmt.Errorf("Replacement %q is retracted", replacement))
+			}
+		}
+	}
 	if len(tagVersionsMap[VersionTagLatest]) != 1 {
-		return errors.New("did not find exactly one latest tag")
+		addError("$.Versions", errors.New("did not find exactly one latest tag"))
 	}
 
-	return nil
+	if responseConfig.MinimumSupportedVersion != "" {
+		minimum, err := semver.NewVersion(responseConfig.MinimumSupportedVersion)
+		if err != nil {
+			addError("$.MinimumSupportedVersion", fmt.Errorf("failed to parse MinimumSupportedVersion: %w", err))
+		} else if latest := tagVersionsMap[VersionTagLatest]; len(latest) == 1 {
+			// Otherwise every client would be end-of-life, even after
+			// upgrading.
+			if latestVersion, err := semver.NewVersion(latest[0].Name); err == nil && latestVersion.LessThan(minimum) {
+				addError("$.MinimumSupportedVersion", fmt.Errorf("MinimumSupportedVersion %q is newer than the version %q tagged %s", responseConfig.MinimumSupportedVersion, latest[0].Name, VersionTagLatest))
+			}
+		}
+	}
+
+	return configErrors
+}
+
+func hasTag(version Version, tag string) bool {
+	for _, t := range version.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
 }
 
 // ReadConfig reads a JSON file, processes the data therein into a ResponseConfig,
 // and validates that ResponseConfig.
 func ReadConfig(configPath string) (ResponseConfig, error) {
+	config, err := ParseConfig(configPath)
+	if err != nil {
+		return ResponseConfig{}, err
+	}
+
+	if err := config.Validate(); err != nil {
+		return ResponseConfig{}, fmt.Errorf("invalid config: %w", err)
+	}
+
+	return config, nil
+}
+
+// ParseConfig reads a JSON file and processes the data therein into a
+// ResponseConfig, without validating it.
+func ParseConfig(configPath string) (ResponseConfig, error) {
 	path := filepath.Clean(configPath)
 	f, err := os.Open(path)
 	if err != nil {
@@ -65,9 +165,5 @@ func ReadConfig(configPath string) (ResponseConfig, error) {
 		config.Versions[i].Supported = true
 	}
 
-	if err := config.Validate(); err != nil {
-		return ResponseConfig{}, fmt.Errorf("invalid config: %w", err)
-	}
-
 	return config, nil
 }
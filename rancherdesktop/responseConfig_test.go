@@ -3,6 +3,7 @@ package rancherdesktop
 import (
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestResponseConfig(t *testing.T) {
@@ -81,6 +82,119 @@ func TestResponseConfig(t *testing.T) {
 				},
 				ExpectedError: "did not find exactly one latest tag",
 			},
+			{
+				Description: "should return error when the version with a latest tag has a rollout",
+				ResponseConfig: ResponseConfig{
+					Versions: []Version{
+						{
+							Name:        "1.2.3",
+							ReleaseDate: "2022-07-28T11:00:00Z",
+							Tags:        []string{"latest"},
+							Rollout: &Rollout{
+								StartTime:  time.Date(2022, 7, 28, 11, 0, 0, 0, time.UTC),
+								Percentage: 10,
+							},
+						},
+					},
+				},
+				ExpectedError: "cannot have a Rollout",
+			},
+			{
+				Description: "should return error when the version with a latest tag is not on the stable channel",
+				ResponseConfig: ResponseConfig{
+					Versions: []Version{
+						{
+							Name:        "1.10.0-beta.1",
+							ReleaseDate: "2022-07-28T11:00:00Z",
+							Tags:        []string{"latest"},
+						},
+					},
+				},
+				ExpectedError: "must be on the stable channel",
+			},
+			{
+				Description: "should return error when MinimumSupportedVersion is not a valid semver",
+				ResponseConfig: ResponseConfig{
+					Versions: []Version{
+						{
+							Name:        "1.2.3",
+							ReleaseDate: "2022-07-28T11:00:00Z",
+							Tags:        []string{"latest"},
+						},
+					},
+					MinimumSupportedVersion: "one",
+				},
+				ExpectedError: "failed to parse MinimumSupportedVersion",
+			},
+			{
+				Description: "should return error when MinimumSupportedVersion is newer than the latest version",
+				ResponseConfig: ResponseConfig{
+					Versions: []Version{
+						{
+							Name:        "1.2.3",
+							ReleaseDate: "2022-07-28T11:00:00Z",
+							Tags:        []string{"latest"},
+						},
+					},
+					MinimumSupportedVersion: "1.3.0",
+				},
+				ExpectedError: `MinimumSupportedVersion "1.3.0" is newer than the version "1.2.3" tagged latest`,
+			},
+			{
+				Description: "should return error when the version with a latest tag is retracted",
+				ResponseConfig: ResponseConfig{
+					Versions: []Version{
+						{
+							Name:        "1.2.3",
+							ReleaseDate: "2022-07-28T11:00:00Z",
+							Tags:        []string{"latest"},
+							Retracted:   &Retraction{Reason: "broken"},
+						},
+					},
+				},
+				ExpectedError: "cannot be retracted",
+			},
+			{
+				Description: "should return error when the Replacement of a retracted version does not exist",
+				ResponseConfig: ResponseConfig{
+					Versions: []Version{
+						{
+							Name:        "1.2.3",
+							ReleaseDate: "2022-07-28T11:00:00Z",
+							Retracted:   &Retraction{Reason: "broken", Replacement: "1.2.4"},
+						},
+						{
+							Name:        "2.3.4",
+							ReleaseDate: "2022-07-28T11:00:00Z",
+							Tags:        []string{"latest"},
+						},
+					},
+				},
+				ExpectedError: `unknown Replacement "1.2.4"`,
+			},
+			{
+				Description: "should return error when the Replacement of a retracted version is retracted",
+				ResponseConfig: ResponseConfig{
+					Versions: []Version{
+						{
+							Name:        "1.2.3",
+							ReleaseDate: "2022-07-28T11:00:00Z",
+							Retracted:   &Retraction{Reason: "broken", Replacement: "1.2.4"},
+						},
+						{
+							Name:        "1.2.4",
+							ReleaseDate: "2022-07-28T11:00:00Z",
+							Retracted:   &Retraction{Reason: "also broken"},
+						},
+						{
+							Name:        "2.3.4",
+							ReleaseDate: "2022-07-28T11:00:00Z",
+							Tags:        []string{"latest"},
+						},
+					},
+				},
+				ExpectedError: `Replacement "1.2.4" is retracted`,
+			},
 		}
 		for _, testCase := range testCases {
 			t.Run(testCase.Description, func(t *testing.T) {
@@ -96,6 +210,42 @@ func TestResponseConfig(t *testing.T) {
 	})
 }
 
+func TestResponseConfigValidationErrors(t *testing.T) {
+	t.Run("should return every error with the path it was found at", func(t *testing.T) {
+		responseConfig := ResponseConfig{
+			Rules: []Rule{
+				newRule(t, "*", "weirdPlatform", "weirdArch", "*", "*"),
+			},
+			Versions: []Version{
+				{
+					Name:        "1.2.3",
+					ReleaseDate: "2022-07-28T11:00:00Z",
+				},
+				{
+					Name:        "1.2.3",
+					ReleaseDate: "notValidRFC3339",
+				},
+			},
+		}
+		expectedErrors := []string{
+			`$.Rules[0]: invalid rule: invalid Criteria.Platform "weirdPlatform"`,
+			`$.Rules[0]: invalid rule: invalid Criteria.Arch "weirdArch"`,
+			`$.Versions[1]: invalid version "1.2.3": failed to parse ReleaseDate`,
+			`$.Versions[1]: duplicate version name "1.2.3"`,
+			`$.Versions: did not find exactly one latest tag`,
+		}
+		errs := responseConfig.ValidationErrors()
+		if len(errs) != len(expectedErrors) {
+			t.Fatalf("unexpected errors %q", errs)
+		}
+		for i, err := range errs {
+			if !strings.HasPrefix(err.Error(), expectedErrors[i]) {
+				t.Errorf("error %q does not start with %q", err, expectedErrors[i])
+			}
+		}
+	})
+}
+
 func TestReadConfig(t *testing.T) {
 	t.Run("all Version.Supported fields in returned config should be true", func(t *testing.T) {
 		config, err := ReadConfig("testdata/test-config.json")
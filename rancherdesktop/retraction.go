@@ -0,0 +1,34 @@
+package rancherdesktop
+
+import (
+	"errors"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// Retraction marks a Version as pulled. A retracted Version is never
+// offered as an upgrade, but is still sent to the clients running it so
+// that they can tell their users why, and what to upgrade to.
+type Retraction struct {
+	// Why the Version was retracted. Shown to users.
+	Reason string
+	// The Name of the Version that clients running the retracted Version
+	// should switch to, if any. It must be a Version of the config that is
+	// not retracted.
+	Replacement string `json:",omitempty"`
+}
+
+// Validate is used to check whether a Retraction is valid.
+func (retraction *Retraction) Validate() error {
+	if retraction.Reason == "" {
+		return errors.New("Reason must be specified")
+	}
+	return nil
+}
+
+// IsRunBy returns true if appVersion, the version a client runs, is
+// version.
+func (version Version) IsRunBy(appVersion *semver.Version) bool {
+	parsedVersion, err := semver.NewVersion(version.Name)
+	return err == nil && parsedVersion.Equal(appVersion)
+}
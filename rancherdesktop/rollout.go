@@ -0,0 +1,101 @@
+package rancherdesktop
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"time"
+)
+
+// ExtraInfoKeyInstanceID is the key in CheckUpgradeRequest.ExtraInfo under
+// which a client sends a stable, random identifier of its installation.
+// It is only used to place the client in rollouts, and is never stored.
+const ExtraInfoKeyInstanceID = "instanceId"
+
+// Rollout restricts a Version to a fraction of clients. The fraction is
+// Percentage from StartTime on, and is changed by each step of Schedule
+// once its time has come. Clients are assigned to the fraction
+// deterministically, so a client that is offered a Version keeps being
+// offered it as the rollout widens.
+type Rollout struct {
+	StartTime  time.Time
+	Percentage float64
+	Schedule   []RolloutStep
+}
+
+// RolloutStep sets the percentage of a Rollout once After has elapsed
+// since Rollout.StartTime.
+type RolloutStep struct {
+	After      Duration
+	Percentage float64
+}
+
+// Validate is used to check whether a Rollout is valid.
+func (rollout *Rollout) Validate() error {
+	if rollout.StartTime.IsZero() {
+		return errors.New("StartTime must be specified")
+	}
+	if err := validatePercentage(rollout.Percentage); err != nil {
+		return fmt.Errorf("invalid Percentage: %w", err)
+	}
+	var previous RolloutStep
+	for i, step := range rollout.Schedule {
+		if err := validatePercentage(step.Percentage); err != nil {
+			return fmt.Errorf("invalid Schedule[%d].Percentage: %w", i, err)
+		}
+		if step.After.Duration <= previous.After.Duration {
+			return fmt.Errorf("Schedule[%d].After must be greater than %v", i, previous.After)
+		}
+		previous = step
+	}
+	return nil
+}
+
+func validatePercentage(percentage float64) error {
+	if percentage < 0 || percentage > 100 {
+		return fmt.Errorf("%v is not between 0 and 100", percentage)
+	}
+	return nil
+}
+
+// PercentageAt returns the percentage of clients that a Rollout includes
+// at the given time.
+func (rollout *Rollout) PercentageAt(t time.Time) float64 {
+	if t.Before(rollout.StartTime) {
+		return 0
+	}
+	percentage := rollout.Percentage
+	for _, step := range rollout.Schedule {
+		if t.Before(rollout.StartTime.Add(step.After.Duration)) {
+			break
+		}
+		percentage = step.Percentage
+	}
+	return percentage
+}
+
+// Includes returns true if the rollout of the Version named versionName
+// includes the client identified by instanceID at the given time. Clients
+// that do not send an instance ID are only included once the rollout
+// reaches 100%.
+func (rollout *Rollout) Includes(versionName, instanceID string, t time.Time) bool {
+	percentage := rollout.PercentageAt(t)
+	if percentage >= 100 {
+		return true
+	}
+	if percentage <= 0 || instanceID == "" {
+		return false
+	}
+	return rolloutBucket(versionName, instanceID) < percentage
+}
+
+// rolloutBucket maps a client to a number in [0, 100). The version name is
+// part of the hash, so that the same clients are not always the first to
+// receive every release.
+func rolloutBucket(versionName, instanceID string) float64 {
+	hash := fnv.New32a()
+	hash.Write([]byte(versionName))
+	hash.Write([]byte{0})
+	hash.Write([]byte(instanceID))
+	return float64(hash.Sum32()%10000) / 100
+}
@@ -0,0 +1,150 @@
+package rancherdesktop
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newRollout(t *testing.T, rawRollout string) *Rollout {
+	var rollout Rollout
+	if err := json.Unmarshal([]byte(rawRollout), &rollout); err != nil {
+		t.Fatalf("failed to parse rollout %s: %s", rawRollout, err)
+	}
+	return &rollout
+}
+
+func TestRollout(t *testing.T) {
+	startTime := time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	t.Run(".Validate", func(t *testing.T) {
+
+		t.Run("should return nil for a valid Rollout", func(t *testing.T) {
+			rollout := newRollout(t, `{
+				"StartTime": "2023-05-01T10:00:00Z",
+				"Percentage": 5,
+				"Schedule": [{"After": "24h", "Percentage": 25}, {"After": "72h", "Percentage": 100}]
+			}`)
+			if err := rollout.Validate(); err != nil {
+				t.Errorf("unexpected error %q", err)
+			}
+		})
+
+		// Test error conditions
+		testCases := []struct {
+			Description   string
+			Rollout       string
+			ExpectedError string
+		}{
+			{
+				Description:   "should return error if StartTime is not specified",
+				Rollout:       `{"Percentage": 5}`,
+				ExpectedError: "StartTime must be specified",
+			},
+			{
+				Description:   "should return error if Percentage is greater than 100",
+				Rollout:       `{"StartTime": "2023-05-01T10:00:00Z", "Percentage": 101}`,
+				ExpectedError: "invalid Percentage",
+			},
+			{
+				Description:   "should return error if Percentage is negative",
+				Rollout:       `{"StartTime": "2023-05-01T10:00:00Z", "Percentage": -1}`,
+				ExpectedError: "invalid Percentage",
+			},
+			{
+				Description:   "should return error if the Percentage of a step is invalid",
+				Rollout:       `{"StartTime": "2023-05-01T10:00:00Z", "Schedule": [{"After": "1h", "Percentage": 200}]}`,
+				ExpectedError: "invalid Schedule[0].Percentage",
+			},
+			{
+				Description:   "should return error if steps are not in increasing order of After",
+				Rollout:       `{"StartTime": "2023-05-01T10:00:00Z", "Schedule": [{"After": "2h", "Percentage": 10}, {"After": "1h", "Percentage": 20}]}`,
+				ExpectedError: "Schedule[1].After must be greater than 2h0m0s",
+			},
+		}
+		for _, testCase := range testCases {
+			t.Run(testCase.Description, func(t *testing.T) {
+				rollout := newRollout(t, testCase.Rollout)
+				err := rollout.Validate()
+				if err == nil {
+					t.Errorf("did not return error for %s", testCase.Rollout)
+				} else if !strings.Contains(err.Error(), testCase.ExpectedError) {
+					t.Errorf("error %q does not contain %q", err, testCase.ExpectedError)
+				}
+			})
+		}
+	})
+
+	t.Run(".PercentageAt", func(t *testing.T) {
+		rollout := newRollout(t, `{
+			"StartTime": "2023-05-01T10:00:00Z",
+			"Percentage": 5,
+			"Schedule": [{"After": "24h", "Percentage": 25}, {"After": "72h", "Percentage": 100}]
+		}`)
+		testCases := []struct {
+			Time               time.Time
+			ExpectedPercentage float64
+		}{
+			{Time: startTime.Add(-time.Second), ExpectedPercentage: 0},
+			{Time: startTime, ExpectedPercentage: 5},
+			{Time: startTime.Add(24*time.Hour - time.Second), ExpectedPercentage: 5},
+			{Time: startTime.Add(24 * time.Hour), ExpectedPercentage: 25},
+			{Time: startTime.Add(72 * time.Hour), ExpectedPercentage: 100},
+			{Time: startTime.Add(1000 * time.Hour), ExpectedPercentage: 100},
+		}
+		for _, testCase := range testCases {
+			percentage := rollout.PercentageAt(testCase.Time)
+			if percentage != testCase.ExpectedPercentage {
+				t.Errorf("unexpected percentage %v at %v", percentage, testCase.Time)
+			}
+		}
+	})
+
+	t.Run(".Includes", func(t *testing.T) {
+
+		t.Run("should include roughly the configured percentage of clients", func(t *testing.T) {
+			rollout := &Rollout{StartTime: startTime, Percentage: 20}
+			included := 0
+			for i := 0; i < 10000; i++ {
+				if rollout.Includes("1.2.3", fmt.Sprintf("instance-%d", i), startTime) {
+					included++
+				}
+			}
+			if included < 1800 || included > 2200 {
+				t.Errorf("unexpected number of included clients %d", included)
+			}
+		})
+
+		t.Run("should keep including a client as the rollout widens", func(t *testing.T) {
+			rollout := newRollout(t, `{
+				"StartTime": "2023-05-01T10:00:00Z",
+				"Percentage": 5,
+				"Schedule": [{"After": "24h", "Percentage": 25}, {"After": "48h", "Percentage": 50}]
+			}`)
+			for i := 0; i < 1000; i++ {
+				instanceID := fmt.Sprintf("instance-%d", i)
+				previouslyIncluded := false
+				for _, after := range []time.Duration{0, 24 * time.Hour, 48 * time.Hour} {
+					included := rollout.Includes("1.2.3", instanceID, startTime.Add(after))
+					if previouslyIncluded && !included {
+						t.Fatalf("client %q was excluded after %v", instanceID, after)
+					}
+					previouslyIncluded = included
+				}
+			}
+		})
+
+		t.Run("should only include clients without an instance ID at 100%", func(t *testing.T) {
+			rollout := &Rollout{StartTime: startTime, Percentage: 99}
+			if rollout.Includes("1.2.3", "", startTime) {
+				t.Error("client without instance ID included at 99%")
+			}
+			rollout.Percentage = 100
+			if !rollout.Includes("1.2.3", "", startTime) {
+				t.Error("client without instance ID not included at 100%")
+			}
+		})
+	})
+}
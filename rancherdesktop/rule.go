@@ -1,11 +1,18 @@
 package rancherdesktop
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
 	"github.com/Masterminds/semver/v3"
 )
 
+var countryCodeRegex = regexp.MustCompile(`^[A-Z]{2}$`)
+
 // Rule represents a constraint on which Versions are supported that
 // applies to instances of Rancher Desktop that satisfy specific criteria.
 type Rule struct {
@@ -16,83 +23,363 @@ type Rule struct {
 // Criteria is the conditions that are used to determine whether a Rule
 // applies for a given client. All parts of Criteria must be satisfied for
 // the Rule to apply to the client.
+//
+// The criteria nested in AnyOf, AllOf and Not have the same fields, but
+// every field is optional there: a field that is not present does not
+// restrict the clients that match.
 type Criteria struct {
-	AppVersion      *semver.Constraints
-	Platform        string
-	Arch            string
+	AppVersion *semver.Constraints
+	// The platforms, or "*" for any platform.
+	Platform StringList
+	// The architectures, or "*" for any architecture.
+	Arch            StringList
 	PlatformVersion *semver.Constraints
+	// ISO 3166-1 alpha-2 codes of the countries the Rule applies to. If
+	// empty, the Rule applies regardless of the country, including to
+	// clients whose country is unknown.
+	Countries []string
+	// ISO 3166-1 alpha-2 codes of the countries the Rule does not apply
+	// to. Clients whose country is unknown are not excluded.
+	ExcludeCountries []string
+	// Conditions on the values of ExtraInfo keys sent by the client, such
+	// as "kubernetesVersion", keyed as sent by the client.
+	ExtraInfo map[string]ExtraInfoMatcher
+	// If not empty, at least one of AnyOf must match.
+	AnyOf []Criteria `json:",omitempty"`
+	// Every one of AllOf must match.
+	AllOf []Criteria `json:",omitempty"`
+	// If set, Not must not match.
+	Not *Criteria `json:",omitempty"`
+}
+
+// StringList is a list of strings that can also be represented in JSON as
+// a single string, which is how Criteria.Platform and Criteria.Arch used
+// to be represented.
+type StringList []string
+
+func (list *StringList) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*list = StringList{single}
+		return nil
+	}
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return fmt.Errorf("must be a string or a list of strings: %w", err)
+	}
+	*list = multiple
+	return nil
+}
+
+func (list StringList) MarshalJSON() ([]byte, error) {
+	if len(list) == 1 {
+		return json.Marshal(list[0])
+	}
+	return json.Marshal([]string(list))
+}
+
+// matchesAny returns true if list does not restrict the values it matches.
+func (list StringList) matchesAny() bool {
+	return len(list) == 0 || containsString(list, "*")
+}
+
+// Matches returns true if value is in list, or if list matches any value.
+func (list StringList) Matches(value string) bool {
+	return list.matchesAny() || containsString(list, value)
 }
 
 // Constraints contains logic that is applied to a Version to determine
 // the value of its Supported key. All parts of Constraints must be satisfied
-// for a Version to be supported.
+// for a Version to be supported. At least one part must be specified.
 type Constraints struct {
 	Version *semver.Constraints
+	// If not empty, only Versions with at least one of Tags are supported.
+	Tags []string
+	// If set, only Versions released at or after ReleasedAfter are
+	// supported.
+	ReleasedAfter time.Time
+	// If set, only Versions released before ReleasedBefore are supported.
+	ReleasedBefore time.Time
+	// If set, only Versions released within ReleasedWithin of the time of
+	// the request are supported.
+	ReleasedWithin Duration
+	// If true, Versions are only supported on a PlatformVersion that is at
+	// least their Version.MinPlatformVersion for the platform of the
+	// client.
+	EnforceMinPlatformVersion bool
 }
 
 // Validate a Rule. Special attention is paid to fields of type
 // *semver.Constraints, because when parsing a Rule from JSON, a field of
 // this type that is not present is set to nil.
 func (rule Rule) Validate() error {
+	if errs := rule.validate(); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// validate returns every problem found in a Rule, in the order in which
+// Validate checks for them.
+func (rule Rule) validate() []error {
+	errs := rule.Criteria.validate("Criteria", false, nil)
+
+	errs = append(errs, rule.Constraints.validate()...)
+
+	return errs
+}
+
+func (constraints Constraints) validate() []error {
+	var errs []error
+
+	// validate Constraints.Version, which is only optional if another
+	// part of Constraints is specified
+	if constraints.Version == nil && len(constraints.Tags) == 0 && constraints.ReleasedAfter.IsZero() &&
+		constraints.ReleasedBefore.IsZero() && constraints.ReleasedWithin.Duration == 0 && !constraints.EnforceMinPlatformVersion {
+		errs = append(errs, fmt.Errorf("invalid Constraints.Version %q", constraints.Version))
+	}
+
+	// validate Constraints.ReleasedAfter and Constraints.ReleasedBefore
+	if !constraints.ReleasedAfter.IsZero() && !constraints.ReleasedBefore.IsZero() &&
+		!constraints.ReleasedAfter.Before(constraints.ReleasedBefore) {
+		errs = append(errs, errors.New("Constraints.ReleasedAfter must be before Constraints.ReleasedBefore"))
+	}
+
+	// validate Constraints.ReleasedWithin
+	if constraints.ReleasedWithin.Duration < 0 {
+		errs = append(errs, fmt.Errorf("invalid Constraints.ReleasedWithin %v: must not be negative", constraints.ReleasedWithin))
+	}
+
+	return errs
+}
+
+// validate returns every problem found in criteria, whose JSON path
+// relative to the Rule is path. The fields of nested criteria are optional.
+// enclosingPlatform is the Platform restriction of the criteria that
+// criteria is nested in, if any, which its PlatformVersion can rely on.
+func (criteria Criteria) validate(path string, nested bool, enclosingPlatform StringList) []error {
+	var errs []error
+
 	// validate Criteria.AppVersion
-	if rule.Criteria.AppVersion == nil {
-		return fmt.Errorf("invalid Criteria.AppVersion %q", rule.Criteria.AppVersion)
+	if criteria.AppVersion == nil && !nested {
+		errs = append(errs, fmt.Errorf("invalid %s.AppVersion %q", path, criteria.AppVersion))
 	}
 
 	// validate Criteria.Platform
-	if rule.Criteria.Platform != "*" && !validPlatform[rule.Criteria.Platform] {
-		return fmt.Errorf("invalid Criteria.Platform %q", rule.Criteria.Platform)
+	if len(criteria.Platform) == 0 && !nested {
+		errs = append(errs, fmt.Errorf("invalid %s.Platform %q", path, ""))
+	}
+	for _, platform := range criteria.Platform {
+		if platform != "*" && !validPlatform[platform] {
+			errs = append(errs, fmt.Errorf("invalid %s.Platform %q", path, platform))
+		}
 	}
 
 	// validate Criteria.Arch
-	if rule.Criteria.Arch != "*" && !validArch[rule.Criteria.Arch] {
-		return fmt.Errorf("invalid Criteria.Arch %q", rule.Criteria.Arch)
+	if len(criteria.Arch) == 0 && !nested {
+		errs = append(errs, fmt.Errorf("invalid %s.Arch %q", path, ""))
+	}
+	for _, arch := range criteria.Arch {
+		if arch != "*" && !validArch[arch] {
+			errs = append(errs, fmt.Errorf("invalid %s.Arch %q", path, arch))
+		}
 	}
 
 	// validate Criteria.PlatformVersion
-	if rule.Criteria.PlatformVersion == nil {
-		return fmt.Errorf("invalid Criteria.PlatformVersion %q", rule.Criteria.PlatformVersion)
+	platform := criteria.Platform
+	if platform.matchesAny() {
+		platform = enclosingPlatform
 	}
-	if rule.Criteria.Platform == "*" && rule.Criteria.PlatformVersion.String() != "*" {
-		return errors.New("Criteria.Platform must be specified if Criteria.PlatformVersion is specified")
+	if criteria.PlatformVersion == nil {
+		if !nested {
+			errs = append(errs, fmt.Errorf("invalid %s.PlatformVersion %q", path, criteria.PlatformVersion))
+		}
+	} else if platform.matchesAny() && criteria.PlatformVersion.String() != "*" {
+		errs = append(errs, fmt.Errorf("%s.Platform must be specified if %s.PlatformVersion is specified", path, path))
 	}
 
-	// validate Constraints.Version
-	if rule.Constraints.Version == nil {
-		return fmt.Errorf("invalid Constraints.Version %q", rule.Constraints.Version)
+	// validate Criteria.Countries and Criteria.ExcludeCountries
+	for i, country := range criteria.Countries {
+		if !countryCodeRegex.MatchString(country) {
+			errs = append(errs, fmt.Errorf("invalid %s.Countries[%d] %q: must be an uppercase ISO 3166-1 alpha-2 code", path, i, country))
+		}
+	}
+	for i, country := range criteria.ExcludeCountries {
+		if !countryCodeRegex.MatchString(country) {
+			errs = append(errs, fmt.Errorf("invalid %s.ExcludeCountries[%d] %q: must be an uppercase ISO 3166-1 alpha-2 code", path, i, country))
+		}
 	}
 
-	return nil
+	// validate Criteria.ExtraInfo
+	keys := make([]string, 0, len(criteria.ExtraInfo))
+	for key := range criteria.ExtraInfo {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if key == "" {
+			errs = append(errs, fmt.Errorf("invalid %s.ExtraInfo: key must not be empty", path))
+		} else if err := criteria.ExtraInfo[key].validate(); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s.ExtraInfo[%q]: %w", path, key, err))
+		}
+	}
+
+	// validate the nested Criteria
+	for i, nestedCriteria := range criteria.AnyOf {
+		errs = append(errs, nestedCriteria.validate(fmt.Sprintf("%s.AnyOf[%d]", path, i), true, platform)...)
+	}
+	for i, nestedCriteria := range criteria.AllOf {
+		errs = append(errs, nestedCriteria.validate(fmt.Sprintf("%s.AllOf[%d]", path, i), true, platform)...)
+	}
+	if criteria.Not != nil {
+		errs = append(errs, criteria.Not.validate(path+".Not", true, platform)...)
+	}
+
+	return errs
 }
 
 // AppliesTo returns true if a Rule applies to a client, which is represented by
 // an InstanceInfo, and false otherwise.
 func (rule Rule) AppliesTo(instanceInfo InstanceInfo) bool {
-	if !rule.Criteria.AppVersion.Check(instanceInfo.AppVersion) {
+	return rule.Criteria.matches(instanceInfo)
+}
+
+// matches returns true if the client represented by instanceInfo satisfies
+// criteria. Fields that are not set are satisfied by every client.
+func (criteria Criteria) matches(instanceInfo InstanceInfo) bool {
+	if criteria.AppVersion != nil && !criteria.AppVersion.Check(instanceInfo.AppVersion) {
+		return false
+	}
+
+	if !criteria.Platform.Matches(instanceInfo.Platform) {
+		return false
+	}
+
+	if !criteria.Arch.Matches(instanceInfo.Arch) {
 		return false
 	}
 
-	if rule.Criteria.Platform != "*" && rule.Criteria.Platform != instanceInfo.Platform {
+	if criteria.PlatformVersion != nil && !criteria.PlatformVersion.Check(instanceInfo.PlatformVersion) {
 		return false
 	}
 
-	if rule.Criteria.Arch != "*" && rule.Criteria.Arch != instanceInfo.Arch {
+	if len(criteria.Countries) > 0 && !containsString(criteria.Countries, instanceInfo.Country) {
 		return false
 	}
 
-	if !rule.Criteria.PlatformVersion.Check(instanceInfo.PlatformVersion) {
+	if instanceInfo.Country != "" && containsString(criteria.ExcludeCountries, instanceInfo.Country) {
+		return false
+	}
+
+	for key, matcher := range criteria.ExtraInfo {
+		value, ok := instanceInfo.ExtraInfo[key]
+		if !ok || !matcher.Matches(value) {
+			return false
+		}
+	}
+
+	if len(criteria.AnyOf) > 0 {
+		matched := false
+		for _, nestedCriteria := range criteria.AnyOf {
+			if nestedCriteria.matches(instanceInfo) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	for _, nestedCriteria := range criteria.AllOf {
+		if !nestedCriteria.matches(instanceInfo) {
+			return false
+		}
+	}
+
+	if criteria.Not != nil && criteria.Not.matches(instanceInfo) {
 		return false
 	}
 
 	return true
 }
 
-// Supported applies Rule.Constraints to a Version in order to determine
-// whether that Version is supported.
+// Supported applies the parts of Rule.Constraints that do not depend on the
+// request to a Version in order to determine whether that Version is
+// supported. The other parts are applied by SupportedFor.
 func (rule Rule) Supported(version Version) (bool, error) {
 	parsedVersion, err := semver.NewVersion(version.Name)
 	if err != nil {
 		return false, fmt.Errorf("failed to parse version %q: %w", version.Name, err)
 	}
-	return rule.Constraints.Version.Check(parsedVersion), nil
+	constraints := rule.Constraints
+	if constraints.Version != nil && !constraints.Version.Check(parsedVersion) {
+		return false, nil
+	}
+
+	if len(constraints.Tags) > 0 {
+		tagged := false
+		for _, tag := range constraints.Tags {
+			if hasTag(version, tag) {
+				tagged = true
+				break
+			}
+		}
+		if !tagged {
+			return false, nil
+		}
+	}
+
+	if !constraints.ReleasedAfter.IsZero() || !constraints.ReleasedBefore.IsZero() {
+		releaseDate, err := time.Parse(time.RFC3339, version.ReleaseDate)
+		if err != nil {
+			return false, fmt.Errorf("failed to parse ReleaseDate of version %q: %w", version.Name, err)
+		}
+		if !constraints.ReleasedAfter.IsZero() && releaseDate.Before(constraints.ReleasedAfter) {
+			return false, nil
+		}
+		if !constraints.ReleasedBefore.IsZero() && !releaseDate.Before(constraints.ReleasedBefore) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// DependsOnRequest returns true if Constraints has parts that can only be
+// applied by SupportedFor.
+func (constraints Constraints) DependsOnRequest() bool {
+	return constraints.ReleasedWithin.Duration > 0 || constraints.EnforceMinPlatformVersion
+}
+
+// SupportedFor applies the parts of Constraints that depend on the request
+// to a Version, for the client represented by instanceInfo at the given
+// time. The Version must be valid.
+func (constraints Constraints) SupportedFor(version Version, instanceInfo InstanceInfo, now time.Time) bool {
+	if constraints.ReleasedWithin.Duration > 0 {
+		releaseDate, err := time.Parse(time.RFC3339, version.ReleaseDate)
+		if err != nil || now.Sub(releaseDate) > constraints.ReleasedWithin.Duration {
+			return false
+		}
+	}
+
+	if constraints.EnforceMinPlatformVersion {
+		if rawMinimum, ok := version.MinPlatformVersion[instanceInfo.Platform]; ok {
+			minimum, err := semver.NewVersion(rawMinimum)
+			if err != nil || instanceInfo.PlatformVersion == nil || instanceInfo.PlatformVersion.LessThan(minimum) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func containsString(list []string, s string) bool {
+	for _, element := range list {
+		if element == s {
+			return true
+		}
+	}
+	return false
 }
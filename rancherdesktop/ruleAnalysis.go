@@ -0,0 +1,212 @@
+package rancherdesktop
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// ConfigWarning is a problem found in a valid ResponseConfig that likely
+// makes it behave differently than intended. Path is the JSON path of the
+// value that the problem was found in.
+type ConfigWarning struct {
+	Path    string
+	Message string
+}
+
+func (configWarning ConfigWarning) String() string {
+	return fmt.Sprintf("%s: %s", configWarning.Path, configWarning.Message)
+}
+
+// AnalyzeRules looks for Rules that can never apply to a client, because
+// a Rule before them applies to every client they apply to, and for Rules
+// that make every Version unsupported. The ResponseConfig must be valid.
+func (responseConfig *ResponseConfig) AnalyzeRules() []ConfigWarning {
+	var warnings []ConfigWarning
+
+	for i, rule := range responseConfig.Rules {
+		path := fmt.Sprintf("$.Rules[%d]", i)
+
+		for j, earlierRule := range responseConfig.Rules[:i] {
+			if earlierRule.Criteria.covers(rule.Criteria) {
+				warnings = append(warnings, ConfigWarning{
+					Path:    path,
+					Message: fmt.Sprintf("rule never applies, because the Criteria of $.Rules[%d] match every client that its Criteria match", j),
+				})
+				break
+			}
+		}
+
+		if len(responseConfig.Versions) > 0 && !rule.supportsAny(responseConfig.Versions) {
+			message := "Constraints make every version unsupported"
+			if rule.Constraints.onlyVersion() {
+				message = fmt.Sprintf("Constraints.Version %q makes every version unsupported", rule.Constraints.Version)
+			}
+			warnings = append(warnings, ConfigWarning{
+				Path:    path,
+				Message: message,
+			})
+		}
+	}
+
+	return warnings
+}
+
+// onlyVersion returns true if Version is the only part of constraints that
+// is specified.
+func (constraints Constraints) onlyVersion() bool {
+	return constraints.Version != nil && len(constraints.Tags) == 0 && constraints.ReleasedAfter.IsZero() &&
+		constraints.ReleasedBefore.IsZero() && !constraints.DependsOnRequest()
+}
+
+// supportsAny returns true if rule supports at least one of versions,
+// ignoring the parts of its Constraints that depend on the request.
+func (rule Rule) supportsAny(versions []Version) bool {
+	for _, version := range versions {
+		if supported, err := rule.Supported(version); err == nil && supported {
+			return true
+		}
+	}
+	return false
+}
+
+// covers returns true if criteria matches every client that other matches.
+// A false result does not mean that there is a client that other matches
+// and criteria does not, only that it could not be shown otherwise.
+//
+// Nested criteria are not analyzed: criteria with nested criteria are never
+// shown to cover other criteria, and the nested criteria of other are
+// ignored, since they can only restrict the clients that other matches.
+func (criteria Criteria) covers(other Criteria) bool {
+	if len(criteria.AnyOf) > 0 || len(criteria.AllOf) > 0 || criteria.Not != nil {
+		return false
+	}
+	if !stringListCovers(criteria.Platform, other.Platform) {
+		return false
+	}
+	if !stringListCovers(criteria.Arch, other.Arch) {
+		return false
+	}
+	return constraintsCover(criteria.AppVersion, other.AppVersion) &&
+		constraintsCover(criteria.PlatformVersion, other.PlatformVersion) &&
+		countriesCover(criteria, other) &&
+		extraInfoCovers(criteria, other)
+}
+
+// extraInfoCovers returns true if every client that the ExtraInfo matchers
+// of other match is also matched by those of criteria.
+func extraInfoCovers(criteria, other Criteria) bool {
+	for key, matcher := range criteria.ExtraInfo {
+		otherMatcher, ok := other.ExtraInfo[key]
+		if !ok || !matcher.covers(otherMatcher) {
+			return false
+		}
+	}
+	return true
+}
+
+// stringListCovers returns true if list matches every value that other
+// matches.
+func stringListCovers(list, other StringList) bool {
+	if list.matchesAny() {
+		return true
+	}
+	if other.matchesAny() {
+		return false
+	}
+	for _, value := range other {
+		if !containsString(list, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// countriesCover returns true if every country that other matches is also
+// matched by criteria, including the unknown country.
+func countriesCover(criteria, other Criteria) bool {
+	if len(criteria.Countries) > 0 {
+		// other must be restricted to countries that criteria includes.
+		if len(other.Countries) == 0 {
+			return false
+		}
+		for _, country := range other.Countries {
+			if !containsString(criteria.Countries, country) {
+				return false
+			}
+		}
+	}
+	for _, country := range criteria.ExcludeCountries {
+		excluded := containsString(other.ExcludeCountries, country) ||
+			(len(other.Countries) > 0 && !containsString(other.Countries, country))
+		if !excluded {
+			return false
+		}
+	}
+	return true
+}
+
+// constraintsCover returns true if every version that satisfies other also
+// satisfies constraints.
+//
+// Constraints are unions of ranges of versions, and the bounds of those
+// ranges can be derived from the versions that appear in them: a version
+// itself, or the next patch, minor or major version for operators such as
+// ~ and ^. Whether a version satisfies the constraints can only change at
+// those bounds, so it is enough to check the bounds and a version between
+// each pair of consecutive bounds. Pre-release versions are not considered.
+func constraintsCover(constraints, other *semver.Constraints) bool {
+	for _, version := range sampleVersions(constraints, other) {
+		if other.Check(version) && !constraints.Check(version) {
+			return false
+		}
+	}
+	return true
+}
+
+var constraintVersionRegex = regexp.MustCompile(`(\d+)(?:\.(\d+|[xX*]))?(?:\.(\d+|[xX*]))?`)
+
+func sampleVersions(constraints ...*semver.Constraints) []*semver.Version {
+	bounds := map[string]semver.Version{}
+	addBound := func(version semver.Version) {
+		bounds[version.String()] = version
+	}
+	addBound(*semver.MustParse("0.0.0"))
+	for _, c := range constraints {
+		for _, match := range constraintVersionRegex.FindAllStringSubmatch(c.String(), -1) {
+			version := semver.New(parseConstraintNumber(match[1]), parseConstraintNumber(match[2]), parseConstraintNumber(match[3]), "", "")
+			addBound(*version)
+			addBound(version.IncPatch())
+			addBound(version.IncMinor())
+			addBound(version.IncMajor())
+		}
+	}
+
+	samples := map[string]semver.Version{}
+	for key, bound := range bounds {
+		samples[key] = bound
+		between := bound.IncPatch()
+		samples[between.String()] = between
+	}
+
+	result := make([]*semver.Version, 0, len(samples))
+	for key := range samples {
+		sample := samples[key]
+		result = append(result, &sample)
+	}
+	sort.Sort(semver.Collection(result))
+	return result
+}
+
+// parseConstraintNumber parses a component of a version in a constraint,
+// treating wildcards and missing components as 0.
+func parseConstraintNumber(component string) uint64 {
+	number, err := strconv.ParseUint(component, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return number
+}
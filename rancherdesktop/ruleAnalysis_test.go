@@ -0,0 +1,162 @@
+package rancherdesktop
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+func TestConstraintsCover(t *testing.T) {
+	testCases := []struct {
+		Constraints string
+		Other       string
+		Expected    bool
+	}{
+		{Constraints: "*", Other: "<1.0.0", Expected: true},
+		{Constraints: "<1.0.0", Other: "*", Expected: false},
+		{Constraints: "<2.0.0", Other: "<1.0.0", Expected: true},
+		{Constraints: "<1.0.0", Other: "<2.0.0", Expected: false},
+		{Constraints: ">=1.2.3", Other: ">1.2.3", Expected: true},
+		{Constraints: ">1.2.3", Other: ">=1.2.3", Expected: false},
+		{Constraints: "~1.2.3", Other: ">=1.2.5, <1.3.0", Expected: true},
+		{Constraints: "~1.2.3", Other: ">=1.2.5, <=1.3.0", Expected: false},
+		{Constraints: "1.x", Other: "^1.2.0", Expected: true},
+		{Constraints: "^1.2.0", Other: "1.x", Expected: false},
+		{Constraints: "<1.0.0 || >2.0.0", Other: ">3.0.0", Expected: true},
+		{Constraints: "<1.0.0 || >2.0.0", Other: ">1.5.0", Expected: false},
+		{Constraints: "!=1.5.0", Other: "1.4.x", Expected: true},
+		{Constraints: "!=1.5.0", Other: "1.x", Expected: false},
+		{Constraints: "1.2.0 - 1.4.0", Other: "1.3.x", Expected: true},
+	}
+	for _, testCase := range testCases {
+		constraints, err := semver.NewConstraint(testCase.Constraints)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %s", testCase.Constraints, err)
+		}
+		other, err := semver.NewConstraint(testCase.Other)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %s", testCase.Other, err)
+		}
+		if result := constraintsCover(constraints, other); result != testCase.Expected {
+			t.Errorf("expected %t for %q covering %q but got %t", testCase.Expected, testCase.Constraints, testCase.Other, result)
+		}
+	}
+}
+
+func TestAnalyzeRules(t *testing.T) {
+	versions := []Version{
+		{Name: "1.2.3", ReleaseDate: "2022-07-28T11:00:00Z"},
+		{Name: "2.3.4", ReleaseDate: "2022-07-28T11:00:00Z", Tags: []string{"latest"}},
+	}
+
+	t.Run("should not return warnings for rules that can apply", func(t *testing.T) {
+		responseConfig := ResponseConfig{
+			Rules: []Rule{
+				newRule(t, "<1.0.0", "darwin", "*", "<11.0.0", "<2.0.0"),
+				newRule(t, "*", "darwin", "*", "*", "*"),
+				newRule(t, "*", "*", "arm64", "*", "*"),
+				parseRule(t, `{"AppVersion": "*", "Platform": "*", "Arch": "*", "PlatformVersion": "*", "Countries": ["CA", "US"]}`, `{"Version": "<2.0.0"}`),
+				parseRule(t, `{"AppVersion": "*", "Platform": "*", "Arch": "*", "PlatformVersion": "*", "Countries": ["US", "FR"]}`, `{"Version": "<2.0.0"}`),
+				parseRule(t, `{"AppVersion": "*", "Platform": "*", "Arch": "*", "PlatformVersion": "*", "ExcludeCountries": ["FR"]}`, `{"Version": "<2.0.0"}`),
+				parseRule(t, `{"AppVersion": "*", "Platform": ["darwin", "linux"], "Arch": "*", "PlatformVersion": "*"}`, `{"Version": "<2.0.0"}`),
+				parseRule(t, `{"AppVersion": "*", "Platform": ["linux", "win32"], "Arch": "*", "PlatformVersion": "*"}`, `{"Version": "<2.0.0"}`),
+			},
+			Versions: versions,
+		}
+		if warnings := responseConfig.AnalyzeRules(); len(warnings) != 0 {
+			t.Errorf("unexpected warnings %v", warnings)
+		}
+	})
+
+	testCases := []struct {
+		Description     string
+		Rules           []Rule
+		ExpectedPath    string
+		ExpectedWarning string
+	}{
+		{
+			Description: "should warn about a rule shadowed by a rule with wildcards",
+			Rules: []Rule{
+				newRule(t, "*", "*", "*", "*", "*"),
+				newRule(t, "*", "darwin", "arm64", "*", "<2.0.0"),
+			},
+			ExpectedPath:    "$.Rules[1]",
+			ExpectedWarning: "Criteria of $.Rules[0] match every client",
+		},
+		{
+			Description: "should warn about a rule shadowed by a rule with a wider version range",
+			Rules: []Rule{
+				newRule(t, "<2.0.0", "darwin", "*", "<12.0.0", "*"),
+				newRule(t, "~1.2.0", "darwin", "x64", "11.x", "<2.0.0"),
+			},
+			ExpectedPath:    "$.Rules[1]",
+			ExpectedWarning: "Criteria of $.Rules[0] match every client",
+		},
+		{
+			Description: "should warn about a rule shadowed by a rule with more countries",
+			Rules: []Rule{
+				parseRule(t, `{"AppVersion": "*", "Platform": "*", "Arch": "*", "PlatformVersion": "*", "Countries": ["CA", "US"]}`, `{"Version": "<2.0.0"}`),
+				parseRule(t, `{"AppVersion": "*", "Platform": "darwin", "Arch": "*", "PlatformVersion": "*", "Countries": ["US"]}`, `{"Version": "<2.0.0"}`),
+			},
+			ExpectedPath:    "$.Rules[1]",
+			ExpectedWarning: "Criteria of $.Rules[0] match every client",
+		},
+		{
+			Description: "should warn about a rule shadowed by a rule excluding fewer countries",
+			Rules: []Rule{
+				parseRule(t, `{"AppVersion": "*", "Platform": "*", "Arch": "*", "PlatformVersion": "*", "ExcludeCountries": ["FR"]}`, `{"Version": "<2.0.0"}`),
+				parseRule(t, `{"AppVersion": "*", "Platform": "*", "Arch": "*", "PlatformVersion": "*", "Countries": ["CA"], "ExcludeCountries": ["US"]}`, `{"Version": "<2.0.0"}`),
+			},
+			ExpectedPath:    "$.Rules[1]",
+			ExpectedWarning: "Criteria of $.Rules[0] match every client",
+		},
+		{
+			Description: "should warn about a rule shadowed by a rule with a wider ExtraInfo matcher",
+			Rules: []Rule{
+				parseRule(t, `{"AppVersion": "*", "Platform": "*", "Arch": "*", "PlatformVersion": "*", "ExtraInfo": {"kubernetesVersion": {"Semver": "<1.24"}}}`, `{"Version": "<2.0.0"}`),
+				parseRule(t, `{"AppVersion": "*", "Platform": "*", "Arch": "*", "PlatformVersion": "*", "ExtraInfo": {
+					"kubernetesVersion": {"Semver": "1.22.x"},
+					"containerEngine": {"Equals": "moby"}
+				}}`, `{"Version": "<2.0.0"}`),
+			},
+			ExpectedPath:    "$.Rules[1]",
+			ExpectedWarning: "Criteria of $.Rules[0] match every client",
+		},
+		{
+			Description: "should warn about a rule shadowed by a rule with more platforms",
+			Rules: []Rule{
+				parseRule(t, `{"AppVersion": "*", "Platform": ["darwin", "linux"], "Arch": "*", "PlatformVersion": "*"}`, `{"Version": "<2.0.0"}`),
+				newRule(t, "*", "linux", "arm64", "*", "<2.0.0"),
+			},
+			ExpectedPath:    "$.Rules[1]",
+			ExpectedWarning: "Criteria of $.Rules[0] match every client",
+		},
+		{
+			Description: "should warn about a rule that makes every version unsupported",
+			Rules: []Rule{
+				newRule(t, "*", "darwin", "*", "*", "<1.0.0"),
+			},
+			ExpectedPath:    "$.Rules[0]",
+			ExpectedWarning: "makes every version unsupported",
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.Description, func(t *testing.T) {
+			responseConfig := ResponseConfig{
+				Rules:    testCase.Rules,
+				Versions: versions,
+			}
+			warnings := responseConfig.AnalyzeRules()
+			if len(warnings) != 1 {
+				t.Fatalf("unexpected warnings %v", warnings)
+			}
+			if warnings[0].Path != testCase.ExpectedPath {
+				t.Errorf("unexpected path %q", warnings[0].Path)
+			}
+			if !strings.Contains(warnings[0].Message, testCase.ExpectedWarning) {
+				t.Errorf("warning %q does not contain %q", warnings[0].Message, testCase.ExpectedWarning)
+			}
+		})
+	}
+}
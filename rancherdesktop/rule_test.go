@@ -1,8 +1,10 @@
 package rancherdesktop
 
 import (
+	"encoding/json"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/Masterminds/semver/v3"
 )
@@ -23,8 +25,8 @@ func newRule(t *testing.T, appVersion, platform, arch, platformVersion, constrai
 	return Rule{
 		Criteria: Criteria{
 			AppVersion:      parsedAppVersion,
-			Platform:        platform,
-			Arch:            arch,
+			Platform:        StringList{platform},
+			Arch:            StringList{arch},
 			PlatformVersion: parsedPlatformVersion,
 		},
 		Constraints: Constraints{
@@ -56,6 +58,16 @@ func newInstanceInfo(t *testing.T, appVersion, platform, arch, platformVersion s
 	}
 }
 
+// parseRule returns the Rule with the given Criteria and Constraints, both
+// given as JSON.
+func parseRule(t *testing.T, criteria, constraints string) Rule {
+	var rule Rule
+	if err := json.Unmarshal([]byte(`{"Criteria": `+criteria+`, "Constraints": `+constraints+`}`), &rule); err != nil {
+		t.Fatalf("failed to parse rule with criteria %s and constraints %s: %s", criteria, constraints, err)
+	}
+	return rule
+}
+
 func TestRule(t *testing.T) {
 
 	t.Run(".Validate", func(t *testing.T) {
@@ -70,6 +82,11 @@ func TestRule(t *testing.T) {
 				newRule(t, "*", "linux", "*", ">1.2.3", "*"),
 				newRule(t, "*", "darwin", "*", ">1.2.3", "*"),
 				newRule(t, "*", "win32", "*", ">1.2.3", "*"),
+				parseRule(t, `{"AppVersion": "*", "Platform": "darwin", "Arch": "*", "PlatformVersion": "*",
+					"AnyOf": [{"PlatformVersion": "<11.0.0"}, {"Not": {"PlatformVersion": ">=13.0.0"}}]}`, `{"Version": "*"}`),
+				parseRule(t, `{"AppVersion": "*", "Platform": "*", "Arch": "*", "PlatformVersion": "*", "Countries": ["CA", "US"], "ExcludeCountries": ["FR"]}`, `{"Version": "*"}`),
+				parseRule(t, `{"AppVersion": "*", "Platform": "*", "Arch": "*", "PlatformVersion": "*"}`, `{"Tags": ["legacy-macos"]}`),
+				parseRule(t, `{"AppVersion": "*", "Platform": "*", "Arch": "*", "PlatformVersion": "*"}`, `{"EnforceMinPlatformVersion": true}`),
 			}
 			for _, rule := range rules {
 				err := rule.Validate()
@@ -91,8 +108,8 @@ func TestRule(t *testing.T) {
 				Rule: Rule{
 					Criteria: Criteria{
 						AppVersion:      nil,
-						Platform:        "darwin",
-						Arch:            "x64",
+						Platform:        StringList{"darwin"},
+						Arch:            StringList{"x64"},
 						PlatformVersion: wildcardConstraint,
 					},
 				},
@@ -128,8 +145,8 @@ func TestRule(t *testing.T) {
 				Rule: Rule{
 					Criteria: Criteria{
 						AppVersion:      wildcardConstraint,
-						Platform:        "darwin",
-						Arch:            "x64",
+						Platform:        StringList{"darwin"},
+						Arch:            StringList{"x64"},
 						PlatformVersion: nil,
 					},
 				},
@@ -140,13 +157,19 @@ func TestRule(t *testing.T) {
 				Rule:          newRule(t, "*", "*", "*", ">1.2.3", "*"),
 				ExpectedError: "Criteria.Platform must be specified if Criteria.PlatformVersion is specified",
 			},
+			{
+				Description: "should return error if nested Criteria.PlatformVersion is specified without any Platform",
+				Rule: parseRule(t, `{"AppVersion": "*", "Platform": "*", "Arch": "*", "PlatformVersion": "*",
+					"AnyOf": [{"Platform": "darwin"}, {"PlatformVersion": "<11.0.0"}]}`, `{"Version": "*"}`),
+				ExpectedError: "Criteria.AnyOf[1].Platform must be specified if Criteria.AnyOf[1].PlatformVersion is specified",
+			},
 			{
 				Description: "should return error if Constraints.Version is nil",
 				Rule: Rule{
 					Criteria: Criteria{
 						AppVersion:      wildcardConstraint,
-						Platform:        "darwin",
-						Arch:            "x64",
+						Platform:        StringList{"darwin"},
+						Arch:            StringList{"x64"},
 						PlatformVersion: wildcardConstraint,
 					},
 					Constraints: Constraints{
@@ -155,6 +178,32 @@ func TestRule(t *testing.T) {
 				},
 				ExpectedError: "invalid Constraints.Version",
 			},
+			{
+				Description:   "should return error if Criteria.Countries contains an invalid code",
+				Rule:          parseRule(t, `{"AppVersion": "*", "Platform": "*", "Arch": "*", "PlatformVersion": "*", "Countries": ["CA", "ca"]}`, `{"Version": "*"}`),
+				ExpectedError: "invalid Criteria.Countries[1]",
+			},
+			{
+				Description:   "should return error if Criteria.ExcludeCountries contains an invalid code",
+				Rule:          parseRule(t, `{"AppVersion": "*", "Platform": "*", "Arch": "*", "PlatformVersion": "*", "ExcludeCountries": ["Canada"]}`, `{"Version": "*"}`),
+				ExpectedError: "invalid Criteria.ExcludeCountries[0]",
+			},
+			{
+				Description:   "should return error if a Criteria.ExtraInfo matcher is invalid",
+				Rule:          parseRule(t, `{"AppVersion": "*", "Platform": "*", "Arch": "*", "PlatformVersion": "*", "ExtraInfo": {"containerEngine": {"In": []}}}`, `{"Version": "*"}`),
+				ExpectedError: `invalid Criteria.ExtraInfo["containerEngine"]: In must not be empty`,
+			},
+			{
+				Description: "should return error if Constraints.ReleasedAfter is not before Constraints.ReleasedBefore",
+				Rule: parseRule(t, `{"AppVersion": "*", "Platform": "*", "Arch": "*", "PlatformVersion": "*"}`,
+					`{"ReleasedAfter": "2023-01-01T00:00:00Z", "ReleasedBefore": "2022-01-01T00:00:00Z"}`),
+				ExpectedError: "Constraints.ReleasedAfter must be before Constraints.ReleasedBefore",
+			},
+			{
+				Description:   "should return error if Constraints.ReleasedWithin is negative",
+				Rule:          parseRule(t, `{"AppVersion": "*", "Platform": "*", "Arch": "*", "PlatformVersion": "*"}`, `{"ReleasedWithin": "-1h"}`),
+				ExpectedError: "invalid Constraints.ReleasedWithin",
+			},
 		}
 		for _, testCase := range testCases {
 			t.Run(testCase.Description, func(t *testing.T) {
@@ -277,6 +326,78 @@ func TestRule(t *testing.T) {
 				InstanceInfo:   newInstanceInfo(t, "1.2.3", "linux", "x64", "12.13.23"),
 				ExpectedReturn: false,
 			},
+			{
+				Description:    "should return true if Country is in Countries",
+				Rule:           parseRule(t, `{"AppVersion": "*", "Platform": "*", "Arch": "*", "PlatformVersion": "*", "Countries": ["CA", "US"]}`, `{"Version": "*"}`),
+				InstanceInfo:   InstanceInfo{AppVersion: semver.MustParse("1.2.3"), Platform: "linux", Arch: "x64", PlatformVersion: semver.MustParse("1.0.0"), Country: "US"},
+				ExpectedReturn: true,
+			},
+			{
+				Description:    "should return false if Country is not in Countries",
+				Rule:           parseRule(t, `{"AppVersion": "*", "Platform": "*", "Arch": "*", "PlatformVersion": "*", "Countries": ["CA", "US"]}`, `{"Version": "*"}`),
+				InstanceInfo:   InstanceInfo{AppVersion: semver.MustParse("1.2.3"), Platform: "linux", Arch: "x64", PlatformVersion: semver.MustParse("1.0.0"), Country: "FR"},
+				ExpectedReturn: false,
+			},
+			{
+				Description:    "should return false if Country is unknown and Countries is set",
+				Rule:           parseRule(t, `{"AppVersion": "*", "Platform": "*", "Arch": "*", "PlatformVersion": "*", "Countries": ["CA", "US"]}`, `{"Version": "*"}`),
+				InstanceInfo:   newInstanceInfo(t, "1.2.3", "linux", "x64", "1.0.0"),
+				ExpectedReturn: false,
+			},
+			{
+				Description:    "should return false if Country is in ExcludeCountries",
+				Rule:           parseRule(t, `{"AppVersion": "*", "Platform": "*", "Arch": "*", "PlatformVersion": "*", "ExcludeCountries": ["FR"]}`, `{"Version": "*"}`),
+				InstanceInfo:   InstanceInfo{AppVersion: semver.MustParse("1.2.3"), Platform: "linux", Arch: "x64", PlatformVersion: semver.MustParse("1.0.0"), Country: "FR"},
+				ExpectedReturn: false,
+			},
+			{
+				Description: "should return true if every Criteria.ExtraInfo matcher matches",
+				Rule: parseRule(t, `{"AppVersion": "*", "Platform": "*", "Arch": "*", "PlatformVersion": "*", "ExtraInfo": {
+					"kubernetesVersion": {"Semver": "<1.24"},
+					"containerEngine": {"In": ["moby"]}
+				}}`, `{"Version": "*"}`),
+				InstanceInfo: InstanceInfo{
+					AppVersion:      semver.MustParse("1.2.3"),
+					Platform:        "linux",
+					Arch:            "x64",
+					PlatformVersion: semver.MustParse("1.0.0"),
+					ExtraInfo: map[string]string{
+						"kubernetesVersion": "1.23.6",
+						"containerEngine":   "moby",
+					},
+				},
+				ExpectedReturn: true,
+			},
+			{
+				Description: "should return false if a Criteria.ExtraInfo matcher does not match",
+				Rule: parseRule(t, `{"AppVersion": "*", "Platform": "*", "Arch": "*", "PlatformVersion": "*", "ExtraInfo": {
+					"kubernetesVersion": {"Semver": "<1.24"},
+					"containerEngine": {"In": ["moby"]}
+				}}`, `{"Version": "*"}`),
+				InstanceInfo: InstanceInfo{
+					AppVersion:      semver.MustParse("1.2.3"),
+					Platform:        "linux",
+					Arch:            "x64",
+					PlatformVersion: semver.MustParse("1.0.0"),
+					ExtraInfo: map[string]string{
+						"kubernetesVersion": "1.23.6",
+						"containerEngine":   "containerd",
+					},
+				},
+				ExpectedReturn: false,
+			},
+			{
+				Description:    "should return false if a Criteria.ExtraInfo key is not sent",
+				Rule:           parseRule(t, `{"AppVersion": "*", "Platform": "*", "Arch": "*", "PlatformVersion": "*", "ExtraInfo": {"containerEngine": {"Equals": "moby"}}}`, `{"Version": "*"}`),
+				InstanceInfo:   newInstanceInfo(t, "1.2.3", "linux", "x64", "1.0.0"),
+				ExpectedReturn: false,
+			},
+			{
+				Description:    "should return true if Country is unknown and ExcludeCountries is set",
+				Rule:           parseRule(t, `{"AppVersion": "*", "Platform": "*", "Arch": "*", "PlatformVersion": "*", "ExcludeCountries": ["FR"]}`, `{"Version": "*"}`),
+				InstanceInfo:   newInstanceInfo(t, "1.2.3", "linux", "x64", "1.0.0"),
+				ExpectedReturn: true,
+			},
 		}
 		for _, testCase := range testCases {
 			t.Run(testCase.Description, func(t *testing.T) {
@@ -314,6 +435,30 @@ func TestRule(t *testing.T) {
 				},
 				ExpectedReturn: true,
 			},
+			{
+				Description:    "should return true for a version with one of the Tags",
+				Rule:           Rule{Constraints: Constraints{Tags: []string{"legacy-macos", "lts"}}},
+				Version:        Version{Name: "1.2.3", ReleaseDate: "2022-07-28T11:00:00Z", Tags: []string{"lts"}},
+				ExpectedReturn: true,
+			},
+			{
+				Description:    "should return false for a version without any of the Tags",
+				Rule:           Rule{Constraints: Constraints{Tags: []string{"legacy-macos"}}},
+				Version:        Version{Name: "1.2.3", ReleaseDate: "2022-07-28T11:00:00Z", Tags: []string{"latest"}},
+				ExpectedReturn: false,
+			},
+			{
+				Description:    "should return true for a version released at ReleasedAfter",
+				Rule:           Rule{Constraints: Constraints{ReleasedAfter: time.Date(2022, 7, 28, 11, 0, 0, 0, time.UTC)}},
+				Version:        Version{Name: "1.2.3", ReleaseDate: "2022-07-28T11:00:00Z"},
+				ExpectedReturn: true,
+			},
+			{
+				Description:    "should return false for a version released at ReleasedBefore",
+				Rule:           Rule{Constraints: Constraints{ReleasedBefore: time.Date(2022, 7, 28, 11, 0, 0, 0, time.UTC)}},
+				Version:        Version{Name: "1.2.3", ReleaseDate: "2022-07-28T11:00:00Z"},
+				ExpectedReturn: false,
+			},
 		}
 		for _, testCase := range testCases {
 			t.Run(testCase.Description, func(t *testing.T) {
@@ -345,4 +490,162 @@ func TestRule(t *testing.T) {
 			}
 		})
 	})
+
+	t.Run(".SupportedFor", func(t *testing.T) {
+		now := time.Date(2022, 8, 28, 11, 0, 0, 0, time.UTC)
+		version := Version{
+			Name:               "1.2.3",
+			ReleaseDate:        "2022-07-28T11:00:00Z",
+			MinPlatformVersion: map[string]string{"darwin": "11.0.0"},
+		}
+		testCases := []struct {
+			Description    string
+			Constraints    Constraints
+			InstanceInfo   InstanceInfo
+			ExpectedReturn bool
+		}{
+			{
+				Description:    "should return true for a version released within ReleasedWithin",
+				Constraints:    Constraints{ReleasedWithin: Duration{31 * 24 * time.Hour}},
+				InstanceInfo:   newInstanceInfo(t, "1.2.3", "darwin", "x64", "10.15.7"),
+				ExpectedReturn: true,
+			},
+			{
+				Description:    "should return false for a version released before ReleasedWithin",
+				Constraints:    Constraints{ReleasedWithin: Duration{30 * 24 * time.Hour}},
+				InstanceInfo:   newInstanceInfo(t, "1.2.3", "darwin", "x64", "10.15.7"),
+				ExpectedReturn: false,
+			},
+			{
+				Description:    "should return false below MinPlatformVersion",
+				Constraints:    Constraints{EnforceMinPlatformVersion: true},
+				InstanceInfo:   newInstanceInfo(t, "1.2.3", "darwin", "x64", "10.15.7"),
+				ExpectedReturn: false,
+			},
+			{
+				Description:    "should return true at MinPlatformVersion",
+				Constraints:    Constraints{EnforceMinPlatformVersion: true},
+				InstanceInfo:   newInstanceInfo(t, "1.2.3", "darwin", "x64", "11.0.0"),
+				ExpectedReturn: true,
+			},
+			{
+				Description:    "should return true for a platform without MinPlatformVersion",
+				Constraints:    Constraints{EnforceMinPlatformVersion: true},
+				InstanceInfo:   newInstanceInfo(t, "1.2.3", "linux", "x64", "1.0.0"),
+				ExpectedReturn: true,
+			},
+			{
+				Description:    "should ignore MinPlatformVersion unless it is enforced",
+				Constraints:    Constraints{},
+				InstanceInfo:   newInstanceInfo(t, "1.2.3", "darwin", "x64", "10.15.7"),
+				ExpectedReturn: true,
+			},
+		}
+		for _, testCase := range testCases {
+			t.Run(testCase.Description, func(t *testing.T) {
+				result := testCase.Constraints.SupportedFor(version, testCase.InstanceInfo, now)
+				if result != testCase.ExpectedReturn {
+					t.Errorf("got result %t but expected %t\nConstraints: %#v\nInstanceInfo: %#v",
+						result, testCase.ExpectedReturn, testCase.Constraints, testCase.InstanceInfo)
+				}
+			})
+		}
+	})
+
+	t.Run("composition", func(t *testing.T) {
+		t.Run("should accept the flat form of Platform and Arch", func(t *testing.T) {
+			rule := parseRule(t, `{"AppVersion": "*", "Platform": "darwin", "Arch": "*", "PlatformVersion": "*"}`, `{"Version": "*"}`)
+			if len(rule.Criteria.Platform) != 1 || rule.Criteria.Platform[0] != "darwin" {
+				t.Errorf("unexpected Platform %#v", rule.Criteria.Platform)
+			}
+			if err := rule.Validate(); err != nil {
+				t.Errorf("unexpected error %q", err)
+			}
+			marshaled, err := json.Marshal(rule.Criteria.Platform)
+			if err != nil || string(marshaled) != `"darwin"` {
+				t.Errorf("unexpected JSON %s, error %v", marshaled, err)
+			}
+		})
+
+		testCases := []struct {
+			Description    string
+			Criteria       string
+			InstanceInfo   InstanceInfo
+			ExpectedReturn bool
+		}{
+			{
+				Description:    "should return true if Platform is in the list",
+				Criteria:       `{"AppVersion": "*", "Platform": ["darwin", "linux"], "Arch": "arm64", "PlatformVersion": "*"}`,
+				InstanceInfo:   newInstanceInfo(t, "1.2.3", "linux", "arm64", "1.0.0"),
+				ExpectedReturn: true,
+			},
+			{
+				Description:    "should return false if Platform is not in the list",
+				Criteria:       `{"AppVersion": "*", "Platform": ["darwin", "linux"], "Arch": "arm64", "PlatformVersion": "*"}`,
+				InstanceInfo:   newInstanceInfo(t, "1.2.3", "win32", "arm64", "1.0.0"),
+				ExpectedReturn: false,
+			},
+			{
+				Description: "should return true if one of AnyOf matches",
+				Criteria: `{"AppVersion": "*", "Platform": "*", "Arch": "*", "PlatformVersion": "*", "AnyOf": [
+					{"Platform": "darwin", "PlatformVersion": "<11.0.0"},
+					{"Platform": "linux", "Arch": "arm64"}
+				]}`,
+				InstanceInfo:   newInstanceInfo(t, "1.2.3", "linux", "arm64", "5.15.0"),
+				ExpectedReturn: true,
+			},
+			{
+				Description: "should return false if none of AnyOf matches",
+				Criteria: `{"AppVersion": "*", "Platform": "*", "Arch": "*", "PlatformVersion": "*", "AnyOf": [
+					{"Platform": "darwin", "PlatformVersion": "<11.0.0"},
+					{"Platform": "linux", "Arch": "arm64"}
+				]}`,
+				InstanceInfo:   newInstanceInfo(t, "1.2.3", "darwin", "arm64", "12.0.0"),
+				ExpectedReturn: false,
+			},
+			{
+				Description: "should return false if one of AllOf does not match",
+				Criteria: `{"AppVersion": "*", "Platform": "*", "Arch": "*", "PlatformVersion": "*", "AllOf": [
+					{"AppVersion": ">=1.0.0"},
+					{"AppVersion": "<1.2.0"}
+				]}`,
+				InstanceInfo:   newInstanceInfo(t, "1.2.3", "darwin", "arm64", "12.0.0"),
+				ExpectedReturn: false,
+			},
+			{
+				Description:    "should return false if Not matches",
+				Criteria:       `{"AppVersion": "*", "Platform": "*", "Arch": "*", "PlatformVersion": "*", "Not": {"Platform": "win32"}}`,
+				InstanceInfo:   newInstanceInfo(t, "1.2.3", "win32", "x64", "10.0.0"),
+				ExpectedReturn: false,
+			},
+			{
+				Description:    "should return true if Not does not match",
+				Criteria:       `{"AppVersion": "*", "Platform": "*", "Arch": "*", "PlatformVersion": "*", "Not": {"Platform": "win32"}}`,
+				InstanceInfo:   newInstanceInfo(t, "1.2.3", "darwin", "x64", "10.0.0"),
+				ExpectedReturn: true,
+			},
+		}
+		for _, testCase := range testCases {
+			t.Run(testCase.Description, func(t *testing.T) {
+				rule := parseRule(t, testCase.Criteria, `{"Version": "*"}`)
+				if err := rule.Validate(); err != nil {
+					t.Fatalf("unexpected error %q", err)
+				}
+				result := rule.AppliesTo(testCase.InstanceInfo)
+				if result != testCase.ExpectedReturn {
+					t.Errorf("got result %t but expected %t\nCriteria: %s\nInstanceInfo: %#v",
+						result, testCase.ExpectedReturn, testCase.Criteria, testCase.InstanceInfo)
+				}
+			})
+		}
+
+		t.Run("should return the path of errors in nested Criteria", func(t *testing.T) {
+			rule := parseRule(t, `{"AppVersion": "*", "Platform": "*", "Arch": "*", "PlatformVersion": "*",
+				"AnyOf": [{"Platform": "darwin"}, {"Arch": "weirdArch"}]}`, `{"Version": "*"}`)
+			expectedError := `invalid Criteria.AnyOf[1].Arch "weirdArch"`
+			if err := rule.Validate(); err == nil || err.Error() != expectedError {
+				t.Errorf("expected error %q but got %v", expectedError, err)
+			}
+		})
+	})
 }
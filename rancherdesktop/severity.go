@@ -0,0 +1,52 @@
+package rancherdesktop
+
+import (
+	"regexp"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+const (
+	// SeveritySecurity marks a Version that fixes security issues.
+	SeveritySecurity = "security"
+	// SeverityCritical marks a Version that fixes issues severe enough
+	// that clients must upgrade to it.
+	SeverityCritical = "critical"
+)
+
+var validSeverity = map[string]bool{
+	"":               true,
+	SeveritySecurity: true,
+	SeverityCritical: true,
+}
+
+var cveRegex = regexp.MustCompile(`^CVE-\d{4}-\d{4,}$`)
+
+// EndOfLife returns true if appVersion is older than the
+// MinimumSupportedVersion of a ResponseConfig. No version is end-of-life if
+// MinimumSupportedVersion is not set.
+func (responseConfig *ResponseConfig) EndOfLife(appVersion *semver.Version) bool {
+	if responseConfig.MinimumSupportedVersion == "" {
+		return false
+	}
+	minimum, err := semver.NewVersion(responseConfig.MinimumSupportedVersion)
+	if err != nil {
+		return false
+	}
+	return appVersion.LessThan(minimum)
+}
+
+// UpgradeRequired returns true if one of versions is a supported Version
+// newer than appVersion with SeverityCritical.
+func UpgradeRequired(appVersion *semver.Version, versions []Version) bool {
+	for _, version := range versions {
+		if !version.Supported || version.Severity != SeverityCritical {
+			continue
+		}
+		parsedVersion, err := semver.NewVersion(version.Name)
+		if err == nil && parsedVersion.GreaterThan(appVersion) {
+			return true
+		}
+	}
+	return false
+}
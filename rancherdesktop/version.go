@@ -1,9 +1,13 @@
 package rancherdesktop
 
 import (
+	"errors"
 	"fmt"
-	"github.com/Masterminds/semver/v3"
+	"sort"
 	"time"
+	"unicode/utf8"
+
+	"github.com/Masterminds/semver/v3"
 )
 
 // Version represents a version of the application. Present in both the config
@@ -18,15 +22,116 @@ type Version struct {
 	Supported bool
 	Tags      []string
 	ExtraInfo map[string]string
+	// Restricts this Version to a fraction of clients. Versions that are
+	// not part of a rollout are offered to every client.
+	Rollout *Rollout `json:",omitempty"`
+	// The minimum version of each platform, keyed by platform, that this
+	// Version runs on. Only enforced by Rules whose Constraints set
+	// EnforceMinPlatformVersion.
+	MinPlatformVersion map[string]string `json:",omitempty"`
+	// The release channels this Version is offered on. If empty, the
+	// channel is derived from Name. See ReleaseChannels.
+	Channels []string `json:",omitempty"`
+	// The files that install this Version. Clients are only sent the
+	// Artifacts for their own platform and arch.
+	Artifacts []Artifact `json:",omitempty"`
+	// Must be an absolute http or https URL if set.
+	ReleaseNotesURL string `json:",omitempty"`
+	// A short description of the changes in this Version, at most
+	// maxSummaryLength characters long.
+	Summary string `json:",omitempty"`
+	// How important it is to upgrade to this Version: empty, or one of
+	// SeveritySecurity and SeverityCritical. Clients must upgrade to a
+	// newer supported Version with SeverityCritical.
+	Severity string `json:",omitempty"`
+	// The identifiers of the vulnerabilities fixed in this Version, such
+	// as CVE-2023-1234.
+	CVEs []string `json:",omitempty"`
+	// Set if this Version was pulled. See Retraction.
+	Retracted *Retraction `json:",omitempty"`
+	// Set if clients running an older version must upgrade to this Version
+	// before they can upgrade to a newer one, for instance because it
+	// migrates their data.
+	SteppingStone bool `json:",omitempty"`
 }
 
 // Validate is used to check whether a Version is valid.
 func (version *Version) Validate() error {
+	if errs := version.validate(); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// validate returns every problem found in a Version, in the order in which
+// Validate checks for them.
+func (version *Version) validate() []error {
+	var errs []error
 	if _, err := semver.StrictNewVersion(version.Name); err != nil {
-		return fmt.Errorf("failed to parse Name: %w", err)
+		errs = append(errs, fmt.Errorf("failed to parse Name: %w", err))
 	}
 	if _, err := time.Parse(time.RFC3339, version.ReleaseDate); err != nil {
-		return fmt.Errorf("failed to parse ReleaseDate: %w", err)
+		errs = append(errs, fmt.Errorf("failed to parse ReleaseDate: %w", err))
 	}
-	return nil
+	platforms := make([]string, 0, len(version.MinPlatformVersion))
+	for platform := range version.MinPlatformVersion {
+		platforms = append(platforms, platform)
+	}
+	sort.Strings(platforms)
+	for _, platform := range platforms {
+		minimum := version.MinPlatformVersion[platform]
+		if !validPlatform[platform] {
+			errs = append(errs, fmt.Errorf("invalid MinPlatformVersion: invalid platform %q", platform))
+		} else if _, err := semver.NewVersion(minimum); err != nil {
+			errs = append(errs, fmt.Errorf("failed to parse MinPlatformVersion[%q]: %w", platform, err))
+		}
+	}
+	for i, channel := range version.Channels {
+		if _, ok := channelRanks[channel]; !ok {
+			errs = append(errs, fmt.Errorf("invalid Channels[%d] %q", i, channel))
+		}
+	}
+	seenArtifacts := map[string]bool{}
+	for i, artifact := range version.Artifacts {
+		if err := artifact.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("invalid Artifacts[%d]: %w", i, err))
+			continue
+		}
+		key := artifact.Platform + "-" + artifact.Arch
+		if seenArtifacts[key] {
+			errs = append(errs, fmt.Errorf("invalid Artifacts[%d]: duplicate artifact for %s", i, key))
+		}
+		seenArtifacts[key] = true
+	}
+	if version.ReleaseNotesURL != "" {
+		if err := validateURL(version.ReleaseNotesURL); err != nil {
+			errs = append(errs, fmt.Errorf("invalid ReleaseNotesURL: %w", err))
+		}
+	}
+	if length := utf8.RuneCountInString(version.Summary); length > maxSummaryLength {
+		errs = append(errs, fmt.Errorf("invalid Summary: %d characters long, must be at most %d", length, maxSummaryLength))
+	}
+	if !validSeverity[version.Severity] {
+		errs = append(errs, fmt.Errorf("invalid Severity %q", version.Severity))
+	}
+	for i, cve := range version.CVEs {
+		if !cveRegex.MatchString(cve) {
+			errs = append(errs, fmt.Errorf("invalid CVEs[%d] %q", i, cve))
+		}
+	}
+	if version.Rollout != nil {
+		if err := version.Rollout.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("invalid Rollout: %w", err))
+		}
+	}
+	if version.Retracted != nil {
+		if err := version.Retracted.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("invalid Retracted: %w", err))
+		}
+		// Clients would otherwise skip it.
+		if version.SteppingStone {
+			errs = append(errs, errors.New("a SteppingStone cannot be Retracted"))
+		}
+	}
+	return errs
 }
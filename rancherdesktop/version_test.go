@@ -20,6 +20,29 @@ func TestVersion(t *testing.T) {
 			}
 		})
 
+		t.Run("should return nil for a version with valid release metadata", func(t *testing.T) {
+			version := Version{
+				Name:        "1.2.3",
+				ReleaseDate: "2022-07-28T11:00:00Z",
+				Artifacts: []Artifact{
+					{
+						Platform:     "darwin",
+						Arch:         "arm64",
+						URL:          "https://example.com/rd-1.2.3-arm64.dmg",
+						Size:         123456,
+						SHA256:       strings.Repeat("0a", 32),
+						SignatureURL: "https://example.com/rd-1.2.3-arm64.dmg.sig",
+					},
+					{Platform: "darwin", Arch: "x64", URL: "https://example.com/rd-1.2.3-x64.dmg"},
+				},
+				ReleaseNotesURL: "https://example.com/releases/1.2.3",
+				Summary:         "Fixes a few bugs.",
+			}
+			if err := version.Validate(); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		})
+
 		// Test error conditions
 		testCases := []struct {
 			Description   string
@@ -58,6 +81,146 @@ func TestVersion(t *testing.T) {
 				},
 				ExpectedError: "failed to parse ReleaseDate",
 			},
+			{
+				Description: "should return error if Version.Rollout is invalid",
+				Version: Version{
+					Name:        "1.2.3",
+					ReleaseDate: "2022-07-28T11:00:00Z",
+					Rollout:     &Rollout{Percentage: 10},
+				},
+				ExpectedError: "invalid Rollout",
+			},
+			{
+				Description: "should return error if Version.MinPlatformVersion has an invalid platform",
+				Version: Version{
+					Name:               "1.2.3",
+					ReleaseDate:        "2022-07-28T11:00:00Z",
+					MinPlatformVersion: map[string]string{"macos": "11.0.0"},
+				},
+				ExpectedError: `invalid MinPlatformVersion: invalid platform "macos"`,
+			},
+			{
+				Description: "should return error if Version.MinPlatformVersion has an invalid version",
+				Version: Version{
+					Name:               "1.2.3",
+					ReleaseDate:        "2022-07-28T11:00:00Z",
+					MinPlatformVersion: map[string]string{"darwin": "Big Sur"},
+				},
+				ExpectedError: `failed to parse MinPlatformVersion["darwin"]`,
+			},
+			{
+				Description: "should return error if an Artifact has an invalid arch",
+				Version: Version{
+					Name:        "1.2.3",
+					ReleaseDate: "2022-07-28T11:00:00Z",
+					Artifacts:   []Artifact{{Platform: "darwin", Arch: "amd64", URL: "https://example.com/rd.dmg"}},
+				},
+				ExpectedError: `invalid Artifacts[0]: invalid Arch "amd64"`,
+			},
+			{
+				Description: "should return error if an Artifact has a relative URL",
+				Version: Version{
+					Name:        "1.2.3",
+					ReleaseDate: "2022-07-28T11:00:00Z",
+					Artifacts:   []Artifact{{Platform: "darwin", Arch: "arm64", URL: "/rd.dmg"}},
+				},
+				ExpectedError: "invalid Artifacts[0]: invalid URL",
+			},
+			{
+				Description: "should return error if an Artifact has a negative Size",
+				Version: Version{
+					Name:        "1.2.3",
+					ReleaseDate: "2022-07-28T11:00:00Z",
+					Artifacts:   []Artifact{{Platform: "darwin", Arch: "arm64", URL: "https://example.com/rd.dmg", Size: -1}},
+				},
+				ExpectedError: "invalid Artifacts[0]: invalid Size",
+			},
+			{
+				Description: "should return error if an Artifact has an invalid SHA256",
+				Version: Version{
+					Name:        "1.2.3",
+					ReleaseDate: "2022-07-28T11:00:00Z",
+					Artifacts:   []Artifact{{Platform: "darwin", Arch: "arm64", URL: "https://example.com/rd.dmg", SHA256: "abc"}},
+				},
+				ExpectedError: "invalid Artifacts[0]: invalid SHA256",
+			},
+			{
+				Description: "should return error if an Artifact has an invalid SignatureURL",
+				Version: Version{
+					Name:        "1.2.3",
+					ReleaseDate: "2022-07-28T11:00:00Z",
+					Artifacts:   []Artifact{{Platform: "darwin", Arch: "arm64", URL: "https://example.com/rd.dmg", SignatureURL: "ftp://example.com/rd.dmg.sig"}},
+				},
+				ExpectedError: "invalid Artifacts[0]: invalid SignatureURL",
+			},
+			{
+				Description: "should return error if two Artifacts are for the same platform and arch",
+				Version: Version{
+					Name:        "1.2.3",
+					ReleaseDate: "2022-07-28T11:00:00Z",
+					Artifacts: []Artifact{
+						{Platform: "darwin", Arch: "arm64", URL: "https://example.com/rd.dmg"},
+						{Platform: "darwin", Arch: "arm64", URL: "https://example.com/rd.zip"},
+					},
+				},
+				ExpectedError: "invalid Artifacts[1]: duplicate artifact for darwin-arm64",
+			},
+			{
+				Description: "should return error if Version.ReleaseNotesURL is invalid",
+				Version: Version{
+					Name:            "1.2.3",
+					ReleaseDate:     "2022-07-28T11:00:00Z",
+					ReleaseNotesURL: "github.com/rancher-sandbox/rancher-desktop/releases",
+				},
+				ExpectedError: "invalid ReleaseNotesURL",
+			},
+			{
+				Description: "should return error if Version.Summary is too long",
+				Version: Version{
+					Name:        "1.2.3",
+					ReleaseDate: "2022-07-28T11:00:00Z",
+					Summary:     strings.Repeat("a", maxSummaryLength+1),
+				},
+				ExpectedError: "invalid Summary",
+			},
+			{
+				Description: "should return error if Version.Severity is unknown",
+				Version: Version{
+					Name:        "1.2.3",
+					ReleaseDate: "2022-07-28T11:00:00Z",
+					Severity:    "urgent",
+				},
+				ExpectedError: `invalid Severity "urgent"`,
+			},
+			{
+				Description: "should return error if Version.CVEs has an invalid identifier",
+				Version: Version{
+					Name:        "1.2.3",
+					ReleaseDate: "2022-07-28T11:00:00Z",
+					Severity:    SeveritySecurity,
+					CVEs:        []string{"CVE-2023-1234", "GHSA-1234"},
+				},
+				ExpectedError: `invalid CVEs[1] "GHSA-1234"`,
+			},
+			{
+				Description: "should return error if Version.Retracted has no Reason",
+				Version: Version{
+					Name:        "1.2.3",
+					ReleaseDate: "2022-07-28T11:00:00Z",
+					Retracted:   &Retraction{Replacement: "1.2.4"},
+				},
+				ExpectedError: "invalid Retracted: Reason must be specified",
+			},
+			{
+				Description: "should return error if Version is a retracted SteppingStone",
+				Version: Version{
+					Name:          "1.2.3",
+					ReleaseDate:   "2022-07-28T11:00:00Z",
+					Retracted:     &Retraction{Reason: "broken"},
+					SteppingStone: true,
+				},
+				ExpectedError: "a SteppingStone cannot be Retracted",
+			},
 		}
 		for _, testCase := range testCases {
 			t.Run(testCase.Description, func(t *testing.T) {
@@ -0,0 +1,151 @@
+package upgraderesponder
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	HTTPHeaderForwarded = "Forwarded"
+	HTTPHeaderXRealIP   = "X-Real-IP"
+)
+
+// DefaultTrustedProxies are the networks trusted to forward requests when
+// none are configured: loopback and private addresses, which is where
+// ingress controllers and load balancers usually connect from.
+var DefaultTrustedProxies = []string{
+	"127.0.0.0/8",
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::1/128",
+	"fc00::/7",
+}
+
+// ParseTrustedProxies parses a list of CIDRs or single IP addresses.
+func ParseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, proxy := range proxies {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		network, err := parseNetwork(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %w", err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// parseNetwork parses a CIDR, or a single IP address as the network made
+// of that address only.
+func parseNetwork(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %q", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(s)
+	return network, err
+}
+
+func isTrusted(ip net.IP, trustedProxies []*net.IPNet) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP address of the client that made req, or nil if
+// it cannot be determined. The forwarding headers are only believed when
+// the request comes from a trusted proxy. They are then walked from the
+// right, the closest hop, skipping trusted proxies, and the first address
+// that is not trusted is the client. The Forwarded header (RFC 7239) takes
+// precedence over X-Forwarded-For, which takes precedence over X-Real-IP.
+func clientIP(req *http.Request, trustedProxies []*net.IPNet) net.IP {
+	peer := parseNode(req.RemoteAddr)
+	if peer == nil || !isTrusted(peer, trustedProxies) {
+		return peer
+	}
+
+	chain := forwardedFor(req.Header.Values(HTTPHeaderForwarded))
+	if len(chain) == 0 {
+		chain = splitHeaderValues(req.Header.Values(HTTPHeaderXForwardedFor))
+	}
+	if len(chain) == 0 {
+		chain = splitHeaderValues(req.Header.Values(HTTPHeaderXRealIP))
+	}
+	if len(chain) == 0 {
+		return peer
+	}
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := parseNode(chain[i])
+		if ip == nil {
+			// An obfuscated or malformed hop hides everything on its left.
+			return nil
+		}
+		if i == 0 || !isTrusted(ip, trustedProxies) {
+			return ip
+		}
+	}
+	return nil
+}
+
+// splitHeaderValues returns the elements of comma-separated header values,
+// in order, across all the occurrences of the header.
+func splitHeaderValues(values []string) []string {
+	var elements []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			if element = strings.TrimSpace(element); element != "" {
+				elements = append(elements, element)
+			}
+		}
+	}
+	return elements
+}
+
+// forwardedFor returns the for parameters of the elements of Forwarded
+// headers, in order.
+func forwardedFor(values []string) []string {
+	var nodes []string
+	for _, element := range splitHeaderValues(values) {
+		for _, pair := range strings.Split(element, ";") {
+			i := strings.Index(pair, "=")
+			if i < 0 || !strings.EqualFold(strings.TrimSpace(pair[:i]), "for") {
+				continue
+			}
+			nodes = append(nodes, strings.Trim(strings.TrimSpace(pair[i+1:]), `"`))
+		}
+	}
+	return nodes
+}
+
+// parseNode parses an address as found in RemoteAddr or in forwarding
+// headers, with or without a port, and with or without brackets around
+// an IPv6 address. It returns nil for anything else, such as the
+// obfuscated identifiers allowed by RFC 7239.
+func parseNode(node string) net.IP {
+	node = strings.TrimSpace(node)
+	if ip := net.ParseIP(node); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return net.ParseIP(host)
+	}
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(node, "["), "]"))
+}
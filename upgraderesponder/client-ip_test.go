@@ -0,0 +1,109 @@
+package upgraderesponder
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trustedProxies, err := ParseTrustedProxies(append(DefaultTrustedProxies, "198.51.100.0/24", "203.0.113.7"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, tc := range []struct {
+		Description string
+		RemoteAddr  string
+		Headers     map[string][]string
+		ExpectedIP  string
+	}{
+		{
+			Description: "should use the socket address without a proxy",
+			RemoteAddr:  "192.0.2.1:1234",
+			ExpectedIP:  "192.0.2.1",
+		},
+		{
+			Description: "should ignore forwarding headers from an untrusted peer",
+			RemoteAddr:  "192.0.2.1:1234",
+			Headers:     map[string][]string{"X-Forwarded-For": {"192.0.2.2"}},
+			ExpectedIP:  "192.0.2.1",
+		},
+		{
+			Description: "should use the socket address of a trusted peer without forwarding headers",
+			RemoteAddr:  "10.0.0.1:1234",
+			ExpectedIP:  "10.0.0.1",
+		},
+		{
+			Description: "should use X-Forwarded-For behind one ingress",
+			RemoteAddr:  "10.0.0.1:1234",
+			Headers:     map[string][]string{"X-Forwarded-For": {"192.0.2.2"}},
+			ExpectedIP:  "192.0.2.2",
+		},
+		{
+			Description: "should skip trusted hops in a comma-separated X-Forwarded-For",
+			RemoteAddr:  "10.0.0.1:1234",
+			Headers:     map[string][]string{"X-Forwarded-For": {"192.0.2.9, 192.0.2.2, 198.51.100.5"}},
+			ExpectedIP:  "192.0.2.2",
+		},
+		{
+			Description: "should walk X-Forwarded-For across several headers",
+			RemoteAddr:  "10.0.0.1:1234",
+			Headers:     map[string][]string{"X-Forwarded-For": {"192.0.2.9, 192.0.2.2", "203.0.113.7"}},
+			ExpectedIP:  "192.0.2.2",
+		},
+		{
+			Description: "should use the leftmost address if every hop is trusted",
+			RemoteAddr:  "10.0.0.1:1234",
+			Headers:     map[string][]string{"X-Forwarded-For": {"10.1.2.3, 10.0.0.2"}},
+			ExpectedIP:  "10.1.2.3",
+		},
+		{
+			Description: "should prefer Forwarded to X-Forwarded-For",
+			RemoteAddr:  "10.0.0.1:1234",
+			Headers: map[string][]string{
+				"Forwarded":       {`for=192.0.2.60;proto=http;by=203.0.113.43, For="[2001:db8:cafe::17]:4711"`},
+				"X-Forwarded-For": {"192.0.2.2"},
+			},
+			ExpectedIP: "2001:db8:cafe::17",
+		},
+		{
+			Description: "should not guess past an obfuscated Forwarded node",
+			RemoteAddr:  "10.0.0.1:1234",
+			Headers:     map[string][]string{"Forwarded": {"for=192.0.2.60, for=_hidden"}},
+			ExpectedIP:  "",
+		},
+		{
+			Description: "should use X-Real-IP without other forwarding headers",
+			RemoteAddr:  "[::1]:1234",
+			Headers:     map[string][]string{"X-Real-Ip": {"192.0.2.3"}},
+			ExpectedIP:  "192.0.2.3",
+		},
+	} {
+		t.Run(tc.Description, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/v1/checkupgrade", nil)
+			req.RemoteAddr = tc.RemoteAddr
+			for name, values := range tc.Headers {
+				for _, value := range values {
+					req.Header.Add(name, value)
+				}
+			}
+			ip := clientIP(req, trustedProxies)
+			if tc.ExpectedIP == "" {
+				if ip != nil {
+					t.Errorf("unexpected IP %v", ip)
+				}
+			} else if ip.String() != tc.ExpectedIP {
+				t.Errorf("unexpected IP %v, expected %v", ip, tc.ExpectedIP)
+			}
+		})
+	}
+
+	t.Run("ParseTrustedProxies should reject invalid proxies", func(t *testing.T) {
+		if _, err := ParseTrustedProxies([]string{"10.0.0.0/33"}); err == nil {
+			t.Errorf("expected error")
+		}
+		if _, err := ParseTrustedProxies([]string{"not-an-ip"}); err == nil {
+			t.Errorf("expected error")
+		}
+	})
+}
@@ -0,0 +1,53 @@
+package upgraderesponder
+
+import (
+	"crypto/sha256"
+	"os"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// watchConfig polls the response config file and reloads it whenever its
+// content changes. The content is compared rather than the modification
+// time, because Kubernetes updates a mounted ConfigMap by swapping a
+// symlink, which does not reliably change the mtime seen through it.
+func (s *Server) watchConfig(stop <-chan struct{}, interval time.Duration) {
+	lastSum, err := fileChecksum(s.configFile)
+	if err != nil {
+		logrus.Errorf("Failed to read config file %v: %v", s.configFile, err)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sum, err := fileChecksum(s.configFile)
+			if err != nil {
+				logrus.Errorf("Failed to read config file %v: %v", s.configFile, err)
+				continue
+			}
+			if sum == lastSum {
+				continue
+			}
+			lastSum = sum
+			logrus.Infof("Config file %v changed, reloading", s.configFile)
+			if err := s.ReloadConfig(); err != nil {
+				logrus.Errorf("Failed to reload config, keeping the previous one: %v", err)
+				continue
+			}
+			logrus.Infof("Config file %v reloaded", s.configFile)
+		case <-stop:
+			return
+		}
+	}
+}
+
+func fileChecksum(path string) ([sha256.Size]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	return sha256.Sum256(content), nil
+}
@@ -2,47 +2,111 @@ package upgraderesponder
 
 import (
 	"fmt"
-	"github.com/Sirupsen/logrus"
-	influxcli "github.com/influxdata/influxdb/client/v2"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/Sirupsen/logrus"
 )
 
-const maxSyncRetries = 5
+const (
+	minSyncBackoff = time.Second
+	maxSyncBackoff = 5 * time.Minute
+)
 
+// DBCacheStats counts what happened to the records added to a DBCache.
+type DBCacheStats struct {
+	// The number of requests waiting to be written: in the queue and kept
+	// after a failed write, or in the spool.
+	Queued int `json:"queued"`
+	// The number of requests added since the start.
+	Added uint64 `json:"added"`
+	// The number of requests dropped because the queue, or the spool with
+	// SpoolDropNewest, was full.
+	Dropped uint64 `json:"dropped"`
+	// The number of spooled requests dropped to make room for new ones,
+	// with SpoolDropOldest.
+	Evicted uint64 `json:"evicted"`
+	// The number of requests written to the metrics backend.
+	Written uint64 `json:"written"`
+	// The number of requests dropped because they could not be written, or
+	// could not be spooled.
+	Failed uint64 `json:"failed"`
+}
+
+// DBCache queues the records of requests and writes them to Sink in the
+// background, so that handling a request never waits for the metrics
+// backend.
+//
+// Without a Spool, records are queued in memory. The queue holds at most
+// QueueSize records. AddRecord never blocks: when the queue is full, the
+// record being added is dropped and counted in DBCacheStats.Dropped. The
+// records of a failed write are kept for the next one, up to QueueSize
+// records.
+//
+// With a Spool, AddRecord appends records to the spool before returning,
+// so that they survive a crash, and the queue is not used. It does not
+// wait for the spool to be flushed to disk, which happens in the
+// background. Records that
+// the spool has no room for are handled according to its drop policy.
+//
+// Records are written every SyncInterval, or as soon as CacheSize records
+// were added since the last sync.
 type DBCache struct {
+	// Accessed atomically, and first in the struct to be 64-bit aligned.
+	added   uint64
+	dropped uint64
+	written uint64
+	failed  uint64
+	// The number of records appended to the spool since the last sync.
+	spooled int64
+	// The number of requests in retained.
+	retainedRequests int64
+
+	// Held while records are written, so that writes never overlap.
 	sync.RWMutex
-	Database     string
-	Precision    string
 	SyncInterval time.Duration
 	CacheSize    int
-	BatchPoints  influxcli.BatchPoints
-	InfluxClient influxcli.Client
-	syncChan     chan struct{}
+	QueueSize    int
+	// If positive, the records of each sync are aggregated per period of
+	// this length before they are written. See aggregateRecords.
+	AggregationPeriod time.Duration
+	Sink              Sink
+	// If set, records are appended to the spool instead of queued, and
+	// kept there until they are written to Sink.
+	Spool    *Spool
+	queue    chan RequestRecord
+	syncChan chan struct{}
+	// Without a spool, the records of the last failed write, which are
+	// written again with the next ones.
+	retained []RequestRecord
+	// After a failed write, writes are not attempted again before
+	// nextAttempt. backoff doubles with each consecutive failure.
+	backoff     time.Duration
+	nextAttempt time.Time
 }
 
-func NewDBCache(database, precision string, syncInterval time.Duration, cacheSize int, influxClient influxcli.Client) (*DBCache, error) {
-	bp, err := influxcli.NewBatchPoints(influxcli.BatchPointsConfig{
-		Database:  database,
-		Precision: precision,
-	})
-	if err != nil {
-		return nil, err
+func NewDBCache(syncInterval time.Duration, cacheSize, queueSize int, sink Sink) (*DBCache, error) {
+	if cacheSize <= 0 {
+		return nil, fmt.Errorf("cache size must be positive")
+	}
+	if queueSize < cacheSize {
+		return nil, fmt.Errorf("queue size %v cannot be smaller than cache size %v", queueSize, cacheSize)
 	}
-
 	dbCache := &DBCache{
-		Database:     database,
-		Precision:    precision,
 		SyncInterval: syncInterval,
 		CacheSize:    cacheSize,
-		BatchPoints:  bp,
-		InfluxClient: influxClient,
-		syncChan:     make(chan struct{}),
+		QueueSize:    queueSize,
+		Sink:         sink,
+		queue:        make(chan RequestRecord, queueSize),
+		syncChan:     make(chan struct{}, 1),
 	}
 
 	return dbCache, nil
 }
 
+// Run writes the queued records to Sink periodically, and once more when
+// stop is closed.
 func (c *DBCache) Run(stop <-chan struct{}) {
 	ticker := time.NewTicker(c.SyncInterval)
 	defer ticker.Stop()
@@ -53,46 +117,183 @@ func (c *DBCache) Run(stop <-chan struct{}) {
 		case <-c.syncChan:
 			c.Sync()
 		case <-stop:
+			// Write what is pending before stopping, since nothing else
+			// will, even if the last write failed recently. With a
+			// spool, records that cannot be written are written after the
+			// next start.
+			c.Lock()
+			c.nextAttempt = time.Time{}
+			c.Unlock()
+			c.Sync()
+			if c.Spool != nil {
+				if err := c.Spool.Close(); err != nil {
+					logrus.Errorf("Failed to close spool: %v", err)
+				}
+			}
 			return
 		}
 	}
 }
 
+// dequeue returns the records queued so far, without waiting for more.
+func (c *DBCache) dequeue() []RequestRecord {
+	var records []RequestRecord
+	for {
+		select {
+		case record := <-c.queue:
+			records = append(records, record)
+		default:
+			return records
+		}
+	}
+}
+
+// Sync writes the queued records, or the spooled records if there is a
+// spool, to Sink. After a failed write, it does nothing until the backoff
+// has elapsed.
 func (c *DBCache) Sync() {
 	c.Lock()
 	defer c.Unlock()
 
-	for i := 0; i < maxSyncRetries; i++ {
-		err := c.InfluxClient.Write(c.BatchPoints)
-		if err == nil {
-			break
-		} else if i < maxSyncRetries {
-			logrus.Debugf("Failed to write %v points to database: %v. Retrying", len(c.BatchPoints.Points()), err)
-		} else {
-			logrus.Debugf("Failed to write %v points to database: %v. Dropped the batch points", len(c.BatchPoints.Points()), err)
+	if time.Now().Before(c.nextAttempt) {
+		return
+	}
+	if c.Spool != nil {
+		c.syncSpool()
+		return
+	}
+
+	records := append(c.retained, c.dequeue()...)
+	if c.AggregationPeriod > 0 {
+		records = aggregateRecords(records, c.AggregationPeriod)
+	}
+	c.retained = nil
+	atomic.StoreInt64(&c.retainedRequests, 0)
+
+	if len(records) == 0 {
+		return
+	}
+
+	if err := c.Sink.Write(records); err != nil {
+		// The oldest records are dropped if there are too many to keep.
+		if excess := len(records) - c.QueueSize; excess > 0 {
+			atomic.AddUint64(&c.failed, uint64(countRequests(records[:excess])))
+			records = records[excess:]
 		}
+		c.retained = records
+		atomic.StoreInt64(&c.retainedRequests, countRequests(records))
+		c.backOff()
+		logrus.Errorf("Failed to write %v points to database: %v. Retrying in %v", len(records), err, c.backoff)
+		return
 	}
+	logrus.Debugf("synced %v points to database", len(records))
+	atomic.AddUint64(&c.written, uint64(countRequests(records)))
+	c.backoff = 0
+}
 
-	logrus.Debugf("synced %v points to database", len(c.BatchPoints.Points()))
+// backOff delays the next write after a failed one.
+func (c *DBCache) backOff() {
+	c.backoff *= 2
+	if c.backoff < minSyncBackoff {
+		c.backoff = minSyncBackoff
+	} else if c.backoff > maxSyncBackoff {
+		c.backoff = maxSyncBackoff
+	}
+	c.nextAttempt = time.Now().Add(c.backoff)
+}
 
-	bp, err := influxcli.NewBatchPoints(influxcli.BatchPointsConfig{
-		Database:  c.Database,
-		Precision: c.Precision,
-	})
+// syncSpool writes the records spooled so far. It never drops records once
+// they are spooled: if the write fails, they stay in the spool.
+func (c *DBCache) syncSpool() {
+	atomic.StoreInt64(&c.spooled, 0)
+	if err := c.Spool.Seal(); err != nil {
+		logrus.Errorf("Failed to seal spool segment: %v", err)
+	}
+	var sink Sink = c.Sink
+	if c.AggregationPeriod > 0 {
+		sink = aggregatingSink{Sink: c.Sink, period: c.AggregationPeriod}
+	}
+	written, err := c.Spool.Drain(sink)
+	atomic.AddUint64(&c.written, uint64(written))
 	if err != nil {
-		panic(fmt.Sprintf("Failed to create new batch points after sync: %v. Crashing the program. Please check the hard-coded parameters", err))
+		c.backOff()
+		logrus.Errorf("Failed to write spooled points to database: %v. Retrying in %v", err, c.backoff)
+		return
 	}
-	c.BatchPoints = bp
-	return
+	c.backoff = 0
 }
 
-func (c *DBCache) AddPoint(p *influxcli.Point) {
-	c.Lock()
-	defer c.Unlock()
+// aggregatingSink aggregates the records of each Write with
+// aggregateRecords before writing them to Sink.
+type aggregatingSink struct {
+	Sink
+	period time.Duration
+}
+
+func (sink aggregatingSink) Write(records []RequestRecord) error {
+	return sink.Sink.Write(aggregateRecords(records, sink.period))
+}
+
+// AddRecord queues record to be written, or appends it to the spool if
+// there is one. It never waits for Sink: without a spool, if the queue is
+// full, record is dropped.
+func (c *DBCache) AddRecord(record RequestRecord) {
+	if c.Spool != nil {
+		c.addSpooledRecord(record)
+		return
+	}
+	select {
+	case c.queue <- record:
+		atomic.AddUint64(&c.added, 1)
+	default:
+		if atomic.AddUint64(&c.dropped, 1) == 1 {
+			logrus.Warnf("The queue of points to write to database is full, dropping points")
+		}
+		return
+	}
+	if len(c.queue) >= c.CacheSize {
+		c.requestSync()
+	}
+}
+
+func (c *DBCache) addSpooledRecord(record RequestRecord) {
+	if err := c.Spool.Append(record); err == errSpoolFull {
+		if atomic.AddUint64(&c.dropped, uint64(record.Requests())) == 1 {
+			logrus.Warnf("The spool of points to write to database is full, dropping points")
+		}
+		return
+	} else if err != nil {
+		atomic.AddUint64(&c.failed, uint64(record.Requests()))
+		logrus.Errorf("Failed to spool point: %v", err)
+		return
+	}
+	atomic.AddUint64(&c.added, 1)
+	if atomic.AddInt64(&c.spooled, 1) >= int64(c.CacheSize) {
+		c.requestSync()
+	}
+}
+
+// requestSync makes Run sync without waiting for SyncInterval.
+func (c *DBCache) requestSync() {
+	// A sync is already pending if the channel is full.
+	select {
+	case c.syncChan <- struct{}{}:
+	default:
+	}
+}
 
-	c.BatchPoints.AddPoint(p)
-	if len(c.BatchPoints.Points()) >= c.CacheSize {
-		c.syncChan <- struct{}{}
+// Stats returns the counts of what happened to the records added so far.
+func (c *DBCache) Stats() DBCacheStats {
+	stats := DBCacheStats{
+		Queued:  len(c.queue) + int(atomic.LoadInt64(&c.retainedRequests)),
+		Added:   atomic.LoadUint64(&c.added),
+		Dropped: atomic.LoadUint64(&c.dropped),
+		Written: atomic.LoadUint64(&c.written),
+		Failed:  atomic.LoadUint64(&c.failed),
+	}
+	if c.Spool != nil {
+		stats.Queued = int(c.Spool.Requests())
+		stats.Evicted = c.Spool.Evicted()
 	}
-	return
+	return stats
 }
@@ -0,0 +1,365 @@
+package upgraderesponder
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+const (
+	GeoResolverMMDB = "mmdb"
+	GeoResolverCSV  = "csv"
+	GeoResolverNone = "none"
+)
+
+// GeoResolver finds where requests come from.
+type GeoResolver interface {
+	// Resolve returns the location of ip, or nil if it is unknown.
+	Resolve(ip net.IP) (*Location, error)
+	// Close releases the data used to resolve locations.
+	Close() error
+}
+
+// geoWatcher is implemented by the GeoResolvers whose data can be reloaded
+// while the server runs.
+type geoWatcher interface {
+	watch(stop <-chan struct{}, interval time.Duration)
+}
+
+// newGeoResolver creates the GeoResolver selected by options.GeoResolver.
+// If it is not set, GeoDB is used if it is set, and locations are not
+// resolved otherwise.
+func newGeoResolver(options ServerOptions) (GeoResolver, error) {
+	name := options.GeoResolver
+	if name == "" {
+		name = GeoResolverNone
+		if options.GeoDB != "" {
+			name = GeoResolverMMDB
+		}
+	}
+	if options.ASNDB != "" && name != GeoResolverMMDB {
+		return nil, fmt.Errorf("an ASN database can only be used with the %v geo resolver", GeoResolverMMDB)
+	}
+
+	switch name {
+	case GeoResolverMMDB:
+		if options.GeoDB == "" {
+			return nil, fmt.Errorf("a GeoDB file must be specified for the %v geo resolver", GeoResolverMMDB)
+		}
+		return newMMDBResolver(options.GeoDB, options.ASNDB)
+	case GeoResolverCSV:
+		if options.GeoCSV == "" {
+			return nil, fmt.Errorf("a CSV file must be specified for the %v geo resolver", GeoResolverCSV)
+		}
+		return newCSVResolver(options.GeoCSV)
+	case GeoResolverNone:
+		logrus.Infof("Locations of requests are not resolved")
+		return noopResolver{}, nil
+	default:
+		return nil, fmt.Errorf("unknown geo resolver %q", name)
+	}
+}
+
+// mmdbResolver resolves locations with a MaxMind city database, and
+// optionally the autonomous systems with a MaxMind ASN database.
+type mmdbResolver struct {
+	db *geoDB
+	// Nil if no ASN database is configured.
+	asnDB *geoDB
+}
+
+type locationRecord struct {
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Continent struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"continent"`
+	Country struct {
+		Names   map[string]string `maxminddb:"names"`
+		ISOCode string            `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+type asnRecord struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+func newMMDBResolver(geoDBPath, asnDBPath string) (*mmdbResolver, error) {
+	db, err := openGeoDB(geoDBPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to open geodb file")
+	}
+	resolver := &mmdbResolver{db: db}
+	logrus.Debugf("GeoDB opened")
+	if asnDBPath != "" {
+		asnDB, err := openGeoDB(asnDBPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "fail to open asn database file")
+		}
+		resolver.asnDB = asnDB
+		logrus.Debugf("ASN database opened")
+	}
+	return resolver, nil
+}
+
+func (resolver *mmdbResolver) Resolve(ip net.IP) (*Location, error) {
+	var (
+		record locationRecord
+		loc    Location
+	)
+
+	err := resolver.db.Lookup(ip, &record)
+	if err != nil {
+		return nil, err
+	}
+
+	loc.City = record.City.Names["en"]
+	loc.Country.Name = record.Country.Names["en"]
+	loc.Country.ISOCode = record.Country.ISOCode
+	loc.Continent = record.Continent.Code
+
+	if resolver.asnDB != nil {
+		// The location is still worth recording without the ASN.
+		var asn asnRecord
+		if err := resolver.asnDB.Lookup(ip, &asn); err != nil {
+			logrus.Debugf("Failed to get ASN for one ip: %v", err)
+		} else {
+			loc.ASN = asn.Number
+			loc.ASOrganization = asn.Organization
+		}
+	}
+	return &loc, nil
+}
+
+func (resolver *mmdbResolver) Close() error {
+	if resolver.asnDB != nil {
+		if err := resolver.asnDB.Close(); err != nil {
+			return err
+		}
+	}
+	return resolver.db.Close()
+}
+
+func (resolver *mmdbResolver) watch(stop <-chan struct{}, interval time.Duration) {
+	if resolver.asnDB != nil {
+		go resolver.asnDB.watch(stop, interval)
+	}
+	resolver.db.watch(stop, interval)
+}
+
+// csvResolver resolves the country of IPs from a static CSV file mapping
+// networks to countries, one per line:
+//
+//	# network,country ISO code[,country name]
+//	192.0.2.0/24,CA,Canada
+//
+// When networks overlap, the most specific one is used. The networks are
+// flattened into sorted ranges that do not overlap when the file is
+// loaded, so that IPs are resolved with a binary search.
+type csvResolver struct {
+	ranges []csvRange
+}
+
+type csvNetwork struct {
+	network  *net.IPNet
+	location Location
+}
+
+// csvRange is the range of IPs from start to end, both included, that
+// resolves to location. IPs are in their 16-byte form.
+type csvRange struct {
+	start    net.IP
+	end      net.IP
+	location *Location
+}
+
+func newCSVResolver(path string) (*csvResolver, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "fail to open geo CSV file")
+	}
+	reader := csv.NewReader(bytes.NewReader(content))
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	var networks []csvNetwork
+	for {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "fail to parse geo CSV file %v", path)
+		}
+		line, _ := reader.FieldPos(0)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("geo CSV file %v: line %v: expected 2 or 3 fields, got %v", path, line, len(fields))
+		}
+		network, err := parseNetwork(strings.TrimSpace(fields[0]))
+		if err != nil {
+			return nil, fmt.Errorf("geo CSV file %v: line %v: %w", path, line, err)
+		}
+		entry := csvNetwork{network: network}
+		// Criteria.Countries only accepts upper case ISO codes.
+		entry.location.Country.ISOCode = strings.ToUpper(strings.TrimSpace(fields[1]))
+		if len(fields) == 3 {
+			entry.location.Country.Name = strings.TrimSpace(fields[2])
+		}
+		networks = append(networks, entry)
+	}
+	resolver := &csvResolver{ranges: flattenNetworks(networks)}
+	logrus.Debugf("Geo CSV file %v loaded with %v networks", path, len(networks))
+	return resolver, nil
+}
+
+// flattenNetworks returns the sorted ranges that do not overlap in which
+// every IP resolves to the location of the most specific network that
+// contains it. If the same network is given several times, the first one
+// is used.
+func flattenNetworks(networks []csvNetwork) []csvRange {
+	type bounds struct {
+		start, end net.IP
+		ones       int
+		location   *Location
+	}
+	sorted := make([]bounds, len(networks))
+	for i := range networks {
+		start, end := networkBounds(networks[i].network)
+		ones, bits := networks[i].network.Mask.Size()
+		if bits == 8*net.IPv4len {
+			ones += 8 * (net.IPv6len - net.IPv4len)
+		}
+		sorted[i] = bounds{start: start, end: end, ones: ones, location: &networks[i].location}
+	}
+	// Containing networks come before the networks they contain.
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if c := bytes.Compare(sorted[i].start, sorted[j].start); c != 0 {
+			return c < 0
+		}
+		return sorted[i].ones < sorted[j].ones
+	})
+
+	var (
+		ranges []csvRange
+		// The networks that contain the cursor, the most specific last.
+		// Networks either contain each other or do not overlap.
+		stack []bounds
+		// The first IP that is not in ranges yet, or nil once the last IP
+		// is.
+		cursor net.IP
+	)
+	emit := func(end net.IP, location *Location) {
+		if cursor != nil && bytes.Compare(cursor, end) <= 0 {
+			ranges = append(ranges, csvRange{start: cursor, end: end, location: location})
+		}
+	}
+	// closeUntil emits the ranges of the networks of stack that end
+	// before ip.
+	closeUntil := func(ip net.IP) {
+		for len(stack) > 0 {
+			top := stack[len(stack)-1]
+			if ip != nil && bytes.Compare(top.end, ip) >= 0 {
+				return
+			}
+			emit(top.end, top.location)
+			stack = stack[:len(stack)-1]
+			cursor = nextIP(top.end)
+		}
+	}
+	for i, network := range sorted {
+		if i > 0 && network.ones == sorted[i-1].ones && network.start.Equal(sorted[i-1].start) {
+			continue
+		}
+		closeUntil(network.start)
+		if len(stack) > 0 {
+			emit(previousIP(network.start), stack[len(stack)-1].location)
+		}
+		cursor = network.start
+		stack = append(stack, network)
+	}
+	closeUntil(nil)
+	return ranges
+}
+
+// networkBounds returns the first and the last IPs of network, in their
+// 16-byte form.
+func networkBounds(network *net.IPNet) (net.IP, net.IP) {
+	mask := network.Mask
+	if len(mask) == net.IPv4len {
+		mask = append(net.CIDRMask(8*(net.IPv6len-net.IPv4len), 8*net.IPv6len)[:net.IPv6len-net.IPv4len], mask...)
+	}
+	start := network.IP.To16().Mask(mask)
+	end := make(net.IP, net.IPv6len)
+	for i := range start {
+		end[i] = start[i] | ^mask[i]
+	}
+	return start, end
+}
+
+// nextIP returns the IP after ip, or nil if ip is the last one.
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			return next
+		}
+	}
+	return nil
+}
+
+// previousIP returns the IP before ip, which must not be the first one.
+func previousIP(ip net.IP) net.IP {
+	previous := make(net.IP, len(ip))
+	copy(previous, ip)
+	for i := len(previous) - 1; i >= 0; i-- {
+		previous[i]--
+		if previous[i] != 0xff {
+			break
+		}
+	}
+	return previous
+}
+
+func (resolver *csvResolver) Resolve(ip net.IP) (*Location, error) {
+	ip = ip.To16()
+	if ip == nil {
+		return nil, nil
+	}
+	i := sort.Search(len(resolver.ranges), func(i int) bool {
+		return bytes.Compare(resolver.ranges[i].end, ip) >= 0
+	})
+	if i == len(resolver.ranges) || bytes.Compare(resolver.ranges[i].start, ip) > 0 {
+		return nil, nil
+	}
+	loc := *resolver.ranges[i].location
+	return &loc, nil
+}
+
+func (resolver *csvResolver) Close() error {
+	return nil
+}
+
+// noopResolver never knows where requests come from.
+type noopResolver struct{}
+
+func (noopResolver) Resolve(ip net.IP) (*Location, error) {
+	return nil, nil
+}
+
+func (noopResolver) Close() error {
+	return nil
+}
@@ -0,0 +1,140 @@
+package upgraderesponder
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGeoResolver(t *testing.T) {
+	ip := net.ParseIP("192.0.2.1")
+
+	t.Run("mmdb should add the continent and the ASN", func(t *testing.T) {
+		dir := t.TempDir()
+		cityPath := filepath.Join(dir, "GeoLite2-City.mmdb")
+		asnPath := filepath.Join(dir, "GeoLite2-ASN.mmdb")
+		writeTestGeoDB(t, cityPath, countryData("CA"))
+		writeTestGeoDB(t, asnPath, map[string]interface{}{
+			"autonomous_system_number":       uint32(13335),
+			"autonomous_system_organization": "CLOUDFLARENET",
+		})
+		resolver, err := newGeoResolver(ServerOptions{GeoDB: cityPath, ASNDB: asnPath})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		loc, err := resolver.Resolve(ip)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		tags := RequestRecord{Location: loc}.Tags()
+		for tag, expected := range map[string]string{
+			InfluxDBTagLocationCountryISOCode: "CA",
+			InfluxDBTagLocationContinent:      "NA",
+			InfluxDBTagASN:                    "13335",
+			InfluxDBTagASOrganization:         "CLOUDFLARENET",
+		} {
+			if tags[tag] != expected {
+				t.Errorf("unexpected value %q for tag %q", tags[tag], tag)
+			}
+		}
+	})
+
+	t.Run("csv should use the most specific network", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "networks.csv")
+		content := "# network,country ISO code,country name\n" +
+			"192.0.2.0/24,CA,Canada\n" +
+			"192.0.2.1, US\n" +
+			"2001:db8::/32,FR,France\n" +
+			"10.0.0.0/8,DE\n" +
+			"10.1.2.0/24,mx\n" +
+			"10.1.0.0/16,BR\n"
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		resolver, err := newGeoResolver(ServerOptions{GeoResolver: GeoResolverCSV, GeoCSV: path})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		for _, tc := range []struct {
+			IP              string
+			ExpectedISOCode string
+			ExpectedName    string
+		}{
+			{"192.0.2.1", "US", ""},
+			{"192.0.2.2", "CA", "Canada"},
+			{"2001:db8::1", "FR", "France"},
+			{"10.0.0.1", "DE", ""},
+			{"10.1.1.1", "BR", ""},
+			{"10.1.2.3", "MX", ""},
+			{"10.1.3.0", "BR", ""},
+			{"10.2.0.0", "DE", ""},
+			{"11.0.0.0", "", ""},
+			{"198.51.100.1", "", ""},
+		} {
+			loc, err := resolver.Resolve(net.ParseIP(tc.IP))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if tc.ExpectedISOCode == "" {
+				if loc != nil {
+					t.Errorf("unexpected location %+v for %v", loc, tc.IP)
+				}
+				continue
+			}
+			if loc == nil || loc.Country.ISOCode != tc.ExpectedISOCode || loc.Country.Name != tc.ExpectedName {
+				t.Errorf("unexpected location %+v for %v", loc, tc.IP)
+			}
+		}
+	})
+
+	t.Run("newGeoResolver should select the resolver from the options", func(t *testing.T) {
+		for _, tc := range []struct {
+			Description   string
+			Options       ServerOptions
+			ExpectedError bool
+		}{
+			{
+				Description: "should not resolve locations without GeoDB",
+				Options:     ServerOptions{},
+			},
+			{
+				Description:   "should require GeoDB for mmdb",
+				Options:       ServerOptions{GeoResolver: GeoResolverMMDB},
+				ExpectedError: true,
+			},
+			{
+				Description:   "should require a CSV file for csv",
+				Options:       ServerOptions{GeoResolver: GeoResolverCSV},
+				ExpectedError: true,
+			},
+			{
+				Description:   "should reject an ASN database without mmdb",
+				Options:       ServerOptions{GeoResolver: GeoResolverNone, ASNDB: "GeoLite2-ASN.mmdb"},
+				ExpectedError: true,
+			},
+			{
+				Description:   "should reject an unknown resolver",
+				Options:       ServerOptions{GeoResolver: "foo"},
+				ExpectedError: true,
+			},
+		} {
+			t.Run(tc.Description, func(t *testing.T) {
+				resolver, err := newGeoResolver(tc.Options)
+				if tc.ExpectedError {
+					if err == nil {
+						t.Errorf("expected error")
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				if loc, err := resolver.Resolve(ip); loc != nil || err != nil {
+					t.Errorf("unexpected location %+v, error %v", loc, err)
+				}
+			})
+		}
+	})
+}
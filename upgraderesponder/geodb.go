@@ -0,0 +1,86 @@
+package upgraderesponder
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	maxminddb "github.com/oschwald/maxminddb-golang"
+)
+
+// geoDB is a MaxMind database that can be reloaded while it is in use.
+//
+// The file is read into memory rather than mapped, so that a reader that
+// has been replaced is simply garbage collected once the lookups using it
+// are done, instead of being unmapped under their feet.
+type geoDB struct {
+	path string
+	// Holds the current *maxminddb.Reader.
+	reader atomic.Value
+	// The checksum of the content the reader was built from. Only accessed
+	// by reload.
+	sum [sha256.Size]byte
+}
+
+func openGeoDB(path string) (*geoDB, error) {
+	db := &geoDB{path: path}
+	if _, err := db.reload(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// reload reads the file again, and replaces the reader if the content
+// changed. If the file cannot be read or is invalid, the current reader is
+// kept.
+func (db *geoDB) reload() (bool, error) {
+	content, err := os.ReadFile(db.path)
+	if err != nil {
+		return false, err
+	}
+	sum := sha256.Sum256(content)
+	if sum == db.sum {
+		return false, nil
+	}
+	reader, err := maxminddb.FromBytes(content)
+	if err != nil {
+		return false, fmt.Errorf("invalid database %v: %w", db.path, err)
+	}
+	db.reader.Store(reader)
+	db.sum = sum
+	logrus.Debugf("GeoDB %v loaded, built at %v", db.path, time.Unix(int64(reader.Metadata.BuildEpoch), 0).UTC())
+	return true, nil
+}
+
+// watch polls the file and reloads it whenever its content changes, like
+// watchConfig does for the response config.
+func (db *geoDB) watch(stop <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			reloaded, err := db.reload()
+			if err != nil {
+				logrus.Errorf("Failed to reload GeoDB, keeping the previous one: %v", err)
+			} else if reloaded {
+				logrus.Infof("GeoDB %v changed, reloaded", db.path)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (db *geoDB) Lookup(ip net.IP, result interface{}) error {
+	return db.reader.Load().(*maxminddb.Reader).Lookup(ip, result)
+}
+
+// Close closes the current reader. Lookups fail once it is closed.
+func (db *geoDB) Close() error {
+	return db.reader.Load().(*maxminddb.Reader).Close()
+}
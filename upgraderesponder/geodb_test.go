@@ -0,0 +1,109 @@
+package upgraderesponder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// encodeMMDBData encodes v in the data section format of MaxMind DB files.
+// Only maps, strings and unsigned integers are supported.
+func encodeMMDBData(v interface{}) []byte {
+	var buf bytes.Buffer
+	control := func(dataType byte, size int) {
+		if size < 29 {
+			buf.WriteByte(dataType<<5 | byte(size))
+		} else {
+			buf.WriteByte(dataType<<5 | 29)
+			buf.WriteByte(byte(size - 29))
+		}
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		control(7, len(v))
+		for key, value := range v {
+			buf.Write(encodeMMDBData(key))
+			buf.Write(encodeMMDBData(value))
+		}
+	case string:
+		control(2, len(v))
+		buf.WriteString(v)
+	case uint32:
+		control(6, 4)
+		binary.Write(&buf, binary.BigEndian, v)
+	}
+	return buf.Bytes()
+}
+
+// writeTestGeoDB writes an IPv4 database in which every IP resolves to
+// data.
+func writeTestGeoDB(t *testing.T, path string, data map[string]interface{}) {
+	var content bytes.Buffer
+	// A single node whose both 24-bit records point to the start of the
+	// data section, which is node count + 16.
+	content.Write([]byte{0, 0, 17, 0, 0, 17})
+	content.Write(make([]byte, 16))
+	content.Write(encodeMMDBData(data))
+	content.WriteString("\xAB\xCD\xEFMaxMind.com")
+	content.Write(encodeMMDBData(map[string]interface{}{
+		"node_count":                  uint32(1),
+		"record_size":                 uint32(24),
+		"ip_version":                  uint32(4),
+		"binary_format_major_version": uint32(2),
+		"database_type":               "Test",
+	}))
+	if err := os.WriteFile(path, content.Bytes(), 0644); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func countryData(isoCode string) map[string]interface{} {
+	return map[string]interface{}{
+		"country":   map[string]interface{}{"iso_code": isoCode},
+		"continent": map[string]interface{}{"code": "NA"},
+	}
+}
+
+func TestGeoDB(t *testing.T) {
+	ip := net.ParseIP("192.0.2.1")
+
+	t.Run("reload should swap the reader when the file changes", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "GeoLite2-City.mmdb")
+		writeTestGeoDB(t, path, countryData("CA"))
+		db, err := openGeoDB(path)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		var record locationRecord
+		if err := db.Lookup(ip, &record); err != nil || record.Country.ISOCode != "CA" {
+			t.Fatalf("unexpected record %+v, error %v", record, err)
+		}
+
+		if reloaded, err := db.reload(); err != nil || reloaded {
+			t.Errorf("unchanged file was reloaded: %v", err)
+		}
+
+		writeTestGeoDB(t, path, countryData("US"))
+		if reloaded, err := db.reload(); err != nil || !reloaded {
+			t.Fatalf("changed file was not reloaded: %v", err)
+		}
+		record = locationRecord{}
+		if err := db.Lookup(ip, &record); err != nil || record.Country.ISOCode != "US" {
+			t.Errorf("unexpected record %+v, error %v", record, err)
+		}
+
+		if err := os.WriteFile(path, []byte("garbage"), 0644); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := db.reload(); err == nil {
+			t.Errorf("expected error")
+		}
+		record = locationRecord{}
+		if err := db.Lookup(ip, &record); err != nil || record.Country.ISOCode != "US" {
+			t.Errorf("previous reader was not kept: %+v, error %v", record, err)
+		}
+	})
+}
@@ -0,0 +1,225 @@
+package upgraderesponder
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	influxcli "github.com/influxdata/influxdb/client/v2"
+
+	"github.com/longhorn/upgrade-responder/utils"
+)
+
+// InfluxDBOptions configures the connection to InfluxDB.
+type InfluxDBOptions struct {
+	URL string
+	// Only used by InfluxDB 1.x.
+	User string
+	Pass string
+	// Only used by InfluxDB 2.x and later.
+	Org    string
+	Bucket string
+	Token  string
+	// Do not create the bucket and the down sampling tasks. InfluxDB 3.x
+	// creates the database on the first write and does not have tasks.
+	SkipSetup bool
+	// Set when records are aggregated. Points then store the number of
+	// requests in the field count, which is summed instead of counted when
+	// down sampling.
+	Aggregated bool
+}
+
+// influxDBSink writes RequestRecords to InfluxDB 1.x, one point per record.
+type influxDBSink struct {
+	client     influxcli.Client
+	aggregated bool
+}
+
+func newInfluxDBSink(options InfluxDBOptions) (*influxDBSink, error) {
+	cfg := influxcli.HTTPConfig{
+		Addr:               options.URL,
+		InsecureSkipVerify: true,
+	}
+	if options.User != "" {
+		cfg.Username = options.User
+	}
+	if options.Pass != "" {
+		cfg.Password = options.Pass
+	}
+	c, err := influxcli.NewHTTPClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Debugf("InfluxDB connection established")
+
+	sink := &influxDBSink{
+		client:     c,
+		aggregated: options.Aggregated,
+	}
+	if err := sink.initDB(); err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+func (sink *influxDBSink) initDB() error {
+	if err := sink.createDB(InfluxDBDatabase); err != nil {
+		return err
+	}
+	if err := sink.createContinuousQueries(InfluxDBDatabase); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (sink *influxDBSink) createDB(name string) error {
+	q := influxcli.NewQuery("CREATE DATABASE "+name, "", "")
+	response, err := sink.client.Query(q)
+	if err != nil {
+		return err
+	}
+	if response.Error() != nil {
+		return response.Error()
+	}
+	logrus.Debugf("Database %v is either created or already exists", name)
+	return nil
+}
+
+func (sink *influxDBSink) createContinuousQueries(dbName string) error {
+	if err := sink.checkContinuousQueries(dbName); err != nil {
+		return err
+	}
+	queryStrings := map[string]string{}
+
+	field, function := countField(sink.aggregated)
+	for _, sampling := range downSamplings {
+		groupBy := fmt.Sprintf("time(%v)", InfluxDBContinuousQueryPeriod)
+		for _, column := range sampling.GroupColumns {
+			groupBy += "," + column
+		}
+		queryStrings[sampling.Name] = fmt.Sprintf("CREATE CONTINUOUS QUERY %v ON %v BEGIN SELECT %v(%v) as total INTO %v FROM %v GROUP BY %v END",
+			sampling.Name, dbName, function, field, sampling.Measurement, InfluxDBMeasurement, groupBy)
+	}
+
+	for queryName, queryString := range queryStrings {
+		query := influxcli.NewQuery(queryString, "", "")
+		response, err := sink.client.Query(query)
+		if err != nil {
+			return err
+		}
+		if err := response.Error(); err != nil {
+			if utils.IsAlreadyExistsError(err) {
+				logrus.Debugf("The continuous query %v is already exists and cannot be modified. If you modified --query-period, please manually drop the continuous query %v from the database %v and retry", queryName, queryName, dbName)
+			}
+			return err
+		}
+		logrus.Debugf("Created continuous query %v", queryName)
+	}
+	return nil
+}
+
+// checkContinuousQueries returns an error if one of the continuous queries
+// that already exist was created for the other --aggregate-requests mode.
+// It would otherwise be kept, and count the wrong field.
+func (sink *influxDBSink) checkContinuousQueries(dbName string) error {
+	response, err := sink.client.Query(influxcli.NewQuery("SHOW CONTINUOUS QUERIES", "", ""))
+	if err != nil {
+		return err
+	}
+	if err := response.Error(); err != nil {
+		return err
+	}
+	field, function := countField(sink.aggregated)
+	expected := fmt.Sprintf("%v(%v)", function, field)
+	for _, result := range response.Results {
+		for _, series := range result.Series {
+			if series.Name != dbName {
+				continue
+			}
+			for _, values := range series.Values {
+				if len(values) < 2 {
+					continue
+				}
+				name, _ := values[0].(string)
+				query, _ := values[1].(string)
+				if isDownSamplingName(name) && !strings.Contains(query, expected) {
+					return errDownSamplingMode("continuous query", name, sink.aggregated)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func isDownSamplingName(name string) bool {
+	for _, sampling := range downSamplings {
+		if sampling.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// errDownSamplingMode is the error returned when an existing down sampling
+// does not match the --aggregate-requests mode.
+func errDownSamplingMode(kind, name string, aggregated bool) error {
+	return fmt.Errorf("the %v %v was created with a different --aggregate-requests than the current %t, "+
+		"so it would not count the requests correctly: delete it so that it is created again, or change --aggregate-requests back",
+		kind, name, aggregated)
+}
+
+func (sink *influxDBSink) Write(records []RequestRecord) error {
+	bp, err := influxcli.NewBatchPoints(influxcli.BatchPointsConfig{
+		Database:  InfluxDBDatabase,
+		Precision: InfluxDBPrecisionNanosecond,
+	})
+	if err != nil {
+		return err
+	}
+	bp.AddPoints(newInfluxDBPoints(records, sink.aggregated))
+	return sink.client.Write(bp)
+}
+
+// newInfluxDBPoints converts records to the points stored for them in
+// InfluxDB, by both the influxdb and influxdb2 backends. The records that
+// cannot be converted are logged and left out.
+func newInfluxDBPoints(records []RequestRecord, aggregated bool) []*influxcli.Point {
+	points := make([]*influxcli.Point, 0, len(records))
+	for _, record := range records {
+		pt, err := newInfluxDBPoint(record, aggregated)
+		if err != nil {
+			// Retrying cannot fix an invalid point, so skip it.
+			logrus.Errorf("Failed to create InfluxDB point: %v", err)
+			continue
+		}
+		points = append(points, pt)
+	}
+	return points
+}
+
+// newInfluxDBPoint converts a RequestRecord to the point stored for it in
+// InfluxDB.
+func newInfluxDBPoint(record RequestRecord, aggregated bool) (*influxcli.Point, error) {
+	fields := map[string]interface{}{
+		utils.ToSnakeCase(ValueFieldKey): ValueFieldValue,
+	}
+	if aggregated {
+		fields = map[string]interface{}{
+			CountFieldKey: record.Requests(),
+		}
+	}
+	return influxcli.NewPoint(InfluxDBMeasurement, record.Tags(), fields, record.Time)
+}
+
+// countField returns the field of the points that the number of requests
+// is derived from, and the function that derives it when down sampling.
+func countField(aggregated bool) (field, function string) {
+	if aggregated {
+		return CountFieldKey, "sum"
+	}
+	return utils.ToSnakeCase(ValueFieldKey), "count"
+}
+
+func (sink *influxDBSink) Close() error {
+	return sink.client.Close()
+}
@@ -0,0 +1,260 @@
+package upgraderesponder
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const influxDB2RequestTimeout = 30 * time.Second
+
+// influxDB2Sink writes RequestRecords to InfluxDB 2.x and later as line
+// protocol, through the /api/v2/write endpoint. The continuous queries used
+// with InfluxDB 1.x are replaced with tasks that down sample the data in the
+// same way.
+type influxDB2Sink struct {
+	url    string
+	org    string
+	bucket string
+	token  string
+	client *http.Client
+	// See InfluxDBOptions.Aggregated.
+	aggregated bool
+}
+
+type influxDB2Org struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type influxDB2Bucket struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name"`
+}
+
+type influxDB2Task struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Flux string `json:"flux"`
+}
+
+func newInfluxDB2Sink(options InfluxDBOptions) (*influxDB2Sink, error) {
+	if options.Org == "" && !options.SkipSetup {
+		return nil, fmt.Errorf("InfluxDB organization must be specified")
+	}
+	sink := &influxDB2Sink{
+		url:    strings.TrimSuffix(options.URL, "/"),
+		org:    options.Org,
+		bucket: options.Bucket,
+		token:  options.Token,
+		client: &http.Client{Timeout: influxDB2RequestTimeout},
+
+		aggregated: options.Aggregated,
+	}
+	if sink.bucket == "" {
+		sink.bucket = InfluxDBDatabase
+	}
+
+	if !options.SkipSetup {
+		if err := sink.setup(); err != nil {
+			return nil, err
+		}
+	}
+	return sink, nil
+}
+
+func (sink *influxDB2Sink) setup() error {
+	orgID, err := sink.findOrgID()
+	if err != nil {
+		return err
+	}
+	if err := sink.createBucket(orgID); err != nil {
+		return err
+	}
+	if err := sink.createDownSamplingTasks(orgID); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (sink *influxDB2Sink) findOrgID() (string, error) {
+	var response struct {
+		Orgs []influxDB2Org `json:"orgs"`
+	}
+	if err := sink.do("GET", "/api/v2/orgs", url.Values{"org": {sink.org}}, nil, &response); err != nil {
+		return "", fmt.Errorf("failed to look up organization %v: %w", sink.org, err)
+	}
+	for _, org := range response.Orgs {
+		if org.Name == sink.org {
+			return org.ID, nil
+		}
+	}
+	return "", fmt.Errorf("organization %v not found", sink.org)
+}
+
+func (sink *influxDB2Sink) createBucket(orgID string) error {
+	var response struct {
+		Buckets []influxDB2Bucket `json:"buckets"`
+	}
+	query := url.Values{"orgID": {orgID}, "name": {sink.bucket}}
+	if err := sink.do("GET", "/api/v2/buckets", query, nil, &response); err != nil {
+		return fmt.Errorf("failed to look up bucket %v: %w", sink.bucket, err)
+	}
+	if len(response.Buckets) > 0 {
+		logrus.Debugf("Bucket %v already exists", sink.bucket)
+		return nil
+	}
+
+	request := map[string]interface{}{
+		"orgID":          orgID,
+		"name":           sink.bucket,
+		"retentionRules": []interface{}{},
+	}
+	if err := sink.do("POST", "/api/v2/buckets", nil, request, nil); err != nil {
+		return fmt.Errorf("failed to create bucket %v: %w", sink.bucket, err)
+	}
+	logrus.Debugf("Created bucket %v", sink.bucket)
+	return nil
+}
+
+func (sink *influxDB2Sink) createDownSamplingTasks(orgID string) error {
+	period, err := time.ParseDuration(InfluxDBContinuousQueryPeriod)
+	if err != nil {
+		return err
+	}
+	for _, sampling := range downSamplings {
+		var response struct {
+			Tasks []influxDB2Task `json:"tasks"`
+		}
+		query := url.Values{"orgID": {orgID}, "name": {sampling.Name}}
+		if err := sink.do("GET", "/api/v2/tasks", query, nil, &response); err != nil {
+			return fmt.Errorf("failed to look up task %v: %w", sampling.Name, err)
+		}
+		if len(response.Tasks) > 0 {
+			// The task would otherwise be kept, and count the wrong field.
+			if !strings.Contains(response.Tasks[0].Flux, countFilter(sink.aggregated)) {
+				return errDownSamplingMode("task", sampling.Name, sink.aggregated)
+			}
+			logrus.Debugf("The task %v already exists and is not modified. If you modified --query-period, please manually delete the task %v and retry", sampling.Name, sampling.Name)
+			continue
+		}
+
+		request := map[string]interface{}{
+			"orgID": orgID,
+			"flux":  sink.downSamplingFlux(sampling, period),
+		}
+		if err := sink.do("POST", "/api/v2/tasks", nil, request, nil); err != nil {
+			return fmt.Errorf("failed to create task %v: %w", sampling.Name, err)
+		}
+		logrus.Debugf("Created task %v", sampling.Name)
+	}
+	return nil
+}
+
+// countFilter returns the Flux predicate that selects the field the number
+// of requests is derived from.
+func countFilter(aggregated bool) string {
+	field, _ := countField(aggregated)
+	return fmt.Sprintf("r._field == %q", field)
+}
+
+// downSamplingFlux returns the Flux script of the task equivalent to a
+// continuous query: it counts the requests of each period into the field
+// total of another measurement, timestamped with the start of the period.
+func (sink *influxDB2Sink) downSamplingFlux(sampling downSampling, period time.Duration) string {
+	groupColumns, _ := json.Marshal(sampling.GroupColumns)
+	_, function := countField(sink.aggregated)
+	return fmt.Sprintf(`option task = {name: %q, every: %ds}
+
+from(bucket: %q)
+    |> range(start: -task.every)
+    |> filter(fn: (r) => r._measurement == %q and %v)
+    |> group(columns: %s)
+    |> aggregateWindow(every: task.every, fn: %v, timeSrc: "_start", createEmpty: false)
+    |> set(key: "_measurement", value: %q)
+    |> set(key: "_field", value: "total")
+    |> to(bucket: %q, org: %q)
+`, sampling.Name, int64(period.Seconds()), sink.bucket, InfluxDBMeasurement, countFilter(sink.aggregated),
+		groupColumns, function, sampling.Measurement, sink.bucket, sink.org)
+}
+
+func (sink *influxDB2Sink) Write(records []RequestRecord) error {
+	var body bytes.Buffer
+	for _, pt := range newInfluxDBPoints(records, sink.aggregated) {
+		body.WriteString(pt.PrecisionString(InfluxDBPrecisionNanosecond))
+		body.WriteByte('\n')
+	}
+
+	query := url.Values{
+		"bucket":    {sink.bucket},
+		"precision": {InfluxDBPrecisionNanosecond},
+	}
+	if sink.org != "" {
+		query.Set("org", sink.org)
+	}
+	return sink.do("POST", "/api/v2/write", query, &body, nil)
+}
+
+// do sends a request to the InfluxDB API. body is sent as is if it is an
+// io.Reader, and as JSON otherwise. If out is not nil, the JSON response is
+// decoded into it.
+func (sink *influxDB2Sink) do(method, path string, query url.Values, body interface{}, out interface{}) error {
+	var (
+		reader      io.Reader
+		contentType string
+	)
+	switch b := body.(type) {
+	case nil:
+	case io.Reader:
+		reader = b
+		contentType = "text/plain; charset=utf-8"
+	default:
+		encoded, err := json.Marshal(b)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+		contentType = "application/json"
+	}
+
+	u := sink.url + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, reader)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if sink.token != "" {
+		req.Header.Set("Authorization", "Token "+sink.token)
+	}
+
+	resp, err := sink.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%v %v returned %v: %s", method, path, resp.Status, strings.TrimSpace(string(message)))
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+func (sink *influxDB2Sink) Close() error {
+	sink.client.CloseIdleConnections()
+	return nil
+}
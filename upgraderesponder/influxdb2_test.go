@@ -0,0 +1,179 @@
+package upgraderesponder
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeInfluxDB2 implements the parts of the InfluxDB 2 API used by
+// influxDB2Sink.
+type fakeInfluxDB2 struct {
+	sync.Mutex
+	token   string
+	buckets []string
+	tasks   []string
+	writes  []string
+}
+
+func (f *fakeInfluxDB2) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	if req.Header.Get("Authorization") != "Token "+f.token {
+		http.Error(rw, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var body map[string]interface{}
+	if req.Header.Get("Content-Type") == "application/json" {
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch req.Method + " " + req.URL.Path {
+	case "GET /api/v2/orgs":
+		json.NewEncoder(rw).Encode(map[string]interface{}{
+			"orgs": []influxDB2Org{{ID: "org-id", Name: req.URL.Query().Get("org")}},
+		})
+	case "GET /api/v2/buckets":
+		buckets := []influxDB2Bucket{}
+		for _, bucket := range f.buckets {
+			if bucket == req.URL.Query().Get("name") {
+				buckets = append(buckets, influxDB2Bucket{Name: bucket})
+			}
+		}
+		json.NewEncoder(rw).Encode(map[string]interface{}{"buckets": buckets})
+	case "POST /api/v2/buckets":
+		f.buckets = append(f.buckets, body["name"].(string))
+		rw.WriteHeader(http.StatusCreated)
+	case "GET /api/v2/tasks":
+		tasks := []influxDB2Task{}
+		for _, task := range f.tasks {
+			if strings.Contains(task, req.URL.Query().Get("name")) {
+				tasks = append(tasks, influxDB2Task{Name: req.URL.Query().Get("name"), Flux: task})
+			}
+		}
+		json.NewEncoder(rw).Encode(map[string]interface{}{"tasks": tasks})
+	case "POST /api/v2/tasks":
+		f.tasks = append(f.tasks, body["flux"].(string))
+		rw.WriteHeader(http.StatusCreated)
+	case "POST /api/v2/write":
+		content, _ := io.ReadAll(req.Body)
+		f.writes = append(f.writes, req.URL.Query().Get("bucket")+"\n"+string(content))
+		rw.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(rw, req)
+	}
+}
+
+func TestInfluxDB2Sink(t *testing.T) {
+	fake := &fakeInfluxDB2{token: "secret"}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	options := InfluxDBOptions{
+		URL:    server.URL,
+		Org:    "my-org",
+		Bucket: "my-bucket",
+		Token:  "secret",
+	}
+
+	t.Run("should create the bucket and the down sampling tasks once", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			if _, err := newInfluxDB2Sink(options); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+		if len(fake.buckets) != 1 || fake.buckets[0] != "my-bucket" {
+			t.Errorf("unexpected buckets %v", fake.buckets)
+		}
+		if len(fake.tasks) != len(downSamplings) {
+			t.Fatalf("unexpected tasks %v", fake.tasks)
+		}
+		for _, expected := range []string{
+			`option task = {name: "cq_by_app_version_down_sampling", every: 3600s}`,
+			`|> group(columns: ["app_version"])`,
+			`|> set(key: "_measurement", value: "by_app_version_down_sampling")`,
+			`|> to(bucket: "my-bucket", org: "my-org")`,
+		} {
+			if !strings.Contains(fake.tasks[1], expected) {
+				t.Errorf("task %s does not contain %s", fake.tasks[1], expected)
+			}
+		}
+	})
+
+	t.Run("should write records as line protocol", func(t *testing.T) {
+		sink, err := newInfluxDB2Sink(options)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		records := []RequestRecord{
+			{Time: time.Unix(0, 1000), AppVersion: "1.2.3"},
+			{Time: time.Unix(0, 2000), AppVersion: "2.3.4", ExtraInfo: map[string]string{"platform": "darwin-x64"}},
+		}
+		if err := sink.Write(records); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		expected := "my-bucket\n" +
+			"upgrade_request,app_version=1.2.3 value=1i 1000\n" +
+			"upgrade_request,app_version=2.3.4,platform=darwin-x64 value=1i 2000\n"
+		if len(fake.writes) != 1 || fake.writes[0] != expected {
+			t.Errorf("unexpected writes %q", fake.writes)
+		}
+	})
+
+	t.Run("should sum the count field of aggregated records", func(t *testing.T) {
+		aggregatedFake := &fakeInfluxDB2{token: "secret"}
+		aggregatedServer := httptest.NewServer(aggregatedFake)
+		defer aggregatedServer.Close()
+		aggregatedOptions := options
+		aggregatedOptions.URL = aggregatedServer.URL
+		aggregatedOptions.Aggregated = true
+
+		sink, err := newInfluxDB2Sink(aggregatedOptions)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		for _, expected := range []string{
+			`r._field == "count"`,
+			`fn: sum`,
+		} {
+			if !strings.Contains(aggregatedFake.tasks[0], expected) {
+				t.Errorf("task %s does not contain %s", aggregatedFake.tasks[0], expected)
+			}
+		}
+
+		records := []RequestRecord{{Time: time.Unix(0, 1000), AppVersion: "1.2.3", Count: 42}}
+		if err := sink.Write(records); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		expected := "my-bucket\nupgrade_request,app_version=1.2.3 count=42i 1000\n"
+		if len(aggregatedFake.writes) != 1 || aggregatedFake.writes[0] != expected {
+			t.Errorf("unexpected writes %q", aggregatedFake.writes)
+		}
+	})
+
+	t.Run("should return an error when the tasks were created for the other aggregation mode", func(t *testing.T) {
+		// The tasks were created by the first subtest without aggregation.
+		aggregatedOptions := options
+		aggregatedOptions.Aggregated = true
+		if _, err := newInfluxDB2Sink(aggregatedOptions); err == nil || !strings.Contains(err.Error(), "--aggregate-requests") {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+
+	t.Run("should return an error when the token is rejected", func(t *testing.T) {
+		badOptions := options
+		badOptions.Token = "wrong"
+		if _, err := newInfluxDB2Sink(badOptions); err == nil || !strings.Contains(err.Error(), "401") {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+}
@@ -0,0 +1,446 @@
+package upgraderesponder
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	localRecordsDir     = "records"
+	localRollupsDir     = "rollups"
+	localFileTimeFormat = "20060102T150405Z"
+	localRecordsExt     = ".jsonl"
+	localRollupsExt     = ".json"
+)
+
+// LocalStorageOptions configures the local backend.
+type LocalStorageOptions struct {
+	// The directory records and rollups are stored in. It is created if it
+	// does not exist.
+	Dir string
+	// How long records and rollups are kept. Zero keeps them forever.
+	Retention time.Duration
+}
+
+// Rollup is the number of requests recorded during one period for one
+// combination of the GroupColumns of a downSampling. It is the equivalent
+// of a point written by a continuous query.
+type Rollup struct {
+	Measurement string `json:"measurement"`
+	// The start of the period.
+	Time  time.Time         `json:"time"`
+	Tags  map[string]string `json:"tags,omitempty"`
+	Total int64             `json:"total"`
+}
+
+// localRecord is how a RequestRecord is stored on disk by localSink.
+type localRecord struct {
+	Time time.Time         `json:"time"`
+	Tags map[string]string `json:"tags"`
+	// Only set for aggregated records.
+	Count int64 `json:"count,omitempty"`
+}
+
+// localSink stores RequestRecords in files on the local disk, and rolls
+// them up the way the continuous queries do, so that no external service
+// is needed. The directory contains:
+//
+//	records/<hour>.jsonl   the records received during each hour, one per line
+//	rollups/<period>.json  the rollups of each --query-period
+//
+// The rollups of the open periods are kept in memory, and the file of a
+// period is rewritten whenever the period gets new records. The rollups of
+// the periods that ended are read from their file when needed.
+type localSink struct {
+	sync.Mutex
+	dir       string
+	retention time.Duration
+	period    time.Duration
+	// Rollups of the periods that are open or have unsaved rollups, keyed
+	// by the Unix time of the start of their period, and then by
+	// rollupKey.
+	rollups map[int64]map[string]*Rollup
+	// Periods whose rollups have not been saved yet.
+	unsaved map[int64]bool
+	// The hour during which the retention was last enforced.
+	retentionHour time.Time
+	// Replaced in tests.
+	now func() time.Time
+}
+
+func newLocalSink(options LocalStorageOptions) (*localSink, error) {
+	if options.Dir == "" {
+		return nil, fmt.Errorf("local storage directory must be specified")
+	}
+	period, err := time.ParseDuration(InfluxDBContinuousQueryPeriod)
+	if err != nil {
+		return nil, fmt.Errorf("invalid query period: %w", err)
+	}
+	if period <= 0 {
+		return nil, fmt.Errorf("query period must be positive")
+	}
+	sink := &localSink{
+		dir:       options.Dir,
+		retention: options.Retention,
+		period:    period,
+		rollups:   map[int64]map[string]*Rollup{},
+		unsaved:   map[int64]bool{},
+		now:       time.Now,
+	}
+	for _, dir := range []string{localRecordsDir, localRollupsDir} {
+		if err := os.MkdirAll(filepath.Join(sink.dir, dir), 0755); err != nil {
+			return nil, err
+		}
+	}
+	sink.enforceRetention()
+	logrus.Debugf("Local storage opened at %v", sink.dir)
+	return sink, nil
+}
+
+// readRollups reads the rollups of the period starting at start from its
+// file. There are none if the file does not exist.
+func (sink *localSink) readRollups(start int64) (map[string]*Rollup, error) {
+	result := map[string]*Rollup{}
+	path := sink.rollupsPath(start)
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return result, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var rollups []Rollup
+	if err := json.Unmarshal(content, &rollups); err != nil {
+		return nil, fmt.Errorf("failed to parse %v: %w", path, err)
+	}
+	for i := range rollups {
+		rollup := rollups[i]
+		result[rollupKey(rollup.Measurement, rollup.Tags)] = &rollup
+	}
+	return result, nil
+}
+
+// loadRollups keeps the rollups of the period starting at start in memory,
+// reading them from its file if they are not, for example when a record
+// arrives late for a period that ended.
+func (sink *localSink) loadRollups(start int64) error {
+	if _, ok := sink.rollups[start]; ok {
+		return nil
+	}
+	rollups, err := sink.readRollups(start)
+	if err != nil {
+		return err
+	}
+	sink.rollups[start] = rollups
+	return nil
+}
+
+// unloadEndedPeriods removes the rollups of the periods that ended from
+// memory, once they are saved.
+func (sink *localSink) unloadEndedPeriods() {
+	now := sink.now()
+	for start := range sink.rollups {
+		if !sink.unsaved[start] && !time.Unix(start, 0).Add(sink.period).After(now) {
+			delete(sink.rollups, start)
+		}
+	}
+}
+
+func rollupKey(measurement string, tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var key strings.Builder
+	key.WriteString(measurement)
+	for _, k := range keys {
+		fmt.Fprintf(&key, "\x00%v=%v", k, tags[k])
+	}
+	return key.String()
+}
+
+func (sink *localSink) Write(records []RequestRecord) error {
+	sink.Lock()
+	defer sink.Unlock()
+
+	// The rollups are loaded and the records are stored first, so that a
+	// failure leaves the rollups untouched for the retry.
+	files := map[string]*bytes.Buffer{}
+	tags := make([]map[string]string, len(records))
+	for i, record := range records {
+		if err := sink.loadRollups(periodStart(record.Time, sink.period).Unix()); err != nil {
+			return err
+		}
+		tags[i] = record.Tags()
+		line, err := json.Marshal(localRecord{Time: record.Time.UTC(), Tags: tags[i], Count: record.Count})
+		if err != nil {
+			return err
+		}
+		name := record.Time.UTC().Truncate(time.Hour).Format(localFileTimeFormat) + localRecordsExt
+		if files[name] == nil {
+			files[name] = &bytes.Buffer{}
+		}
+		files[name].Write(line)
+		files[name].WriteByte('\n')
+	}
+	if err := sink.appendRecords(files); err != nil {
+		return err
+	}
+
+	for i, record := range records {
+		start := periodStart(record.Time, sink.period)
+		rollups := sink.rollups[start.Unix()]
+		for _, sampling := range downSamplings {
+			groupTags := make(map[string]string, len(sampling.GroupColumns))
+			for _, column := range sampling.GroupColumns {
+				groupTags[column] = tags[i][column]
+			}
+			key := rollupKey(sampling.Measurement, groupTags)
+			rollup, ok := rollups[key]
+			if !ok {
+				rollup = &Rollup{Measurement: sampling.Measurement, Time: start, Tags: groupTags}
+				rollups[key] = rollup
+			}
+			rollup.Total += record.Requests()
+		}
+		sink.unsaved[start.Unix()] = true
+	}
+
+	// The records are stored, so retrying would count them twice. Rollups
+	// that cannot be saved now are saved by the next Write or by Close.
+	if err := sink.saveRollups(); err != nil {
+		logrus.Errorf("Failed to save rollups: %v", err)
+	}
+	sink.unloadEndedPeriods()
+	sink.enforceRetention()
+	return nil
+}
+
+// appendRecords appends content to each file of records, keyed by name.
+// Either every file is appended to, or none is: if one of them cannot be
+// appended to, the others are truncated back to their previous size, so
+// that retrying the Write does not store their records twice.
+func (sink *localSink) appendRecords(files map[string]*bytes.Buffer) error {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// The size of each file appended to so far before it was appended
+	// to, or -1 if it did not exist.
+	sizes := map[string]int64{}
+	for _, name := range names {
+		path := filepath.Join(sink.dir, localRecordsDir, name)
+		size := int64(-1)
+		if info, err := os.Stat(path); err == nil {
+			size = info.Size()
+		}
+		sizes[path] = size
+		if err := appendFile(path, files[name].Bytes()); err != nil {
+			for path, size := range sizes {
+				if err := truncateFile(path, size); err != nil {
+					logrus.Errorf("Failed to remove partially stored records from %v: %v", path, err)
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// truncateFile truncates the file at path to size, or removes it if size
+// is negative.
+func truncateFile(path string, size int64) error {
+	if size < 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return os.Truncate(path, size)
+}
+
+func appendFile(path string, content []byte) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// saveRollups writes the file of every period with unsaved rollups. Each
+// file is replaced atomically, so that it is never left half written.
+func (sink *localSink) saveRollups() error {
+	for start := range sink.unsaved {
+		rollups := sink.sortedRollups(sink.rollups[start])
+		content, err := json.Marshal(rollups)
+		if err != nil {
+			return err
+		}
+		path := sink.rollupsPath(start)
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, content, 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			return err
+		}
+		delete(sink.unsaved, start)
+	}
+	return nil
+}
+
+func (sink *localSink) rollupsPath(start int64) string {
+	name := time.Unix(start, 0).UTC().Format(localFileTimeFormat) + localRollupsExt
+	return filepath.Join(sink.dir, localRollupsDir, name)
+}
+
+// parseFileTime returns the time a file of records or rollups is named
+// after, and false if it is not such a file.
+func parseFileTime(name, ext string) (time.Time, bool) {
+	if filepath.Ext(name) != ext {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(localFileTimeFormat, strings.TrimSuffix(name, ext))
+	return t, err == nil
+}
+
+func (sink *localSink) sortedRollups(rollups map[string]*Rollup) []Rollup {
+	keys := make([]string, 0, len(rollups))
+	for key := range rollups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := make([]Rollup, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, *rollups[key])
+	}
+	return result
+}
+
+// enforceRetention removes the records and the rollups of the periods
+// that ended before the retention. Since files only expire by the hour, it
+// only looks for them once per hour. Failures are only logged, since the
+// files are removed on the next attempt.
+func (sink *localSink) enforceRetention() {
+	if sink.retention <= 0 {
+		return
+	}
+	now := sink.now()
+	if hour := now.Truncate(time.Hour); !hour.Equal(sink.retentionHour) {
+		sink.retentionHour = hour
+	} else {
+		return
+	}
+	cutoff := now.Add(-sink.retention)
+
+	for start := range sink.rollups {
+		if !time.Unix(start, 0).Add(sink.period).After(cutoff) {
+			delete(sink.rollups, start)
+			delete(sink.unsaved, start)
+		}
+	}
+	sink.removeExpiredFiles(localRollupsDir, localRollupsExt, sink.period, cutoff)
+	sink.removeExpiredFiles(localRecordsDir, localRecordsExt, time.Hour, cutoff)
+}
+
+// removeExpiredFiles removes the files of subdir whose span, which starts
+// at the time they are named after and lasts span, ended before cutoff.
+func (sink *localSink) removeExpiredFiles(subdir, ext string, span time.Duration, cutoff time.Time) {
+	dir := filepath.Join(sink.dir, subdir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		logrus.Errorf("Failed to list %v: %v", subdir, err)
+		return
+	}
+	for _, entry := range entries {
+		start, ok := parseFileTime(entry.Name(), ext)
+		if !ok || start.Add(span).After(cutoff) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+			logrus.Errorf("Failed to remove expired %v: %v", subdir, err)
+		}
+	}
+}
+
+// Rollups returns the rollups of measurement for the periods starting in
+// [start, end), ordered by time. The rollups of the current period are
+// updated as requests are recorded.
+func (sink *localSink) Rollups(measurement string, start, end time.Time) ([]Rollup, error) {
+	if !isDownSamplingMeasurement(measurement) {
+		return nil, fmt.Errorf("unknown measurement %q", measurement)
+	}
+
+	sink.Lock()
+	defer sink.Unlock()
+
+	// The periods in memory may not be saved yet, and the others are only
+	// on disk.
+	inRange := map[int64]bool{}
+	for periodStart := range sink.rollups {
+		t := time.Unix(periodStart, 0)
+		inRange[periodStart] = !t.Before(start) && t.Before(end)
+	}
+	entries, err := os.ReadDir(filepath.Join(sink.dir, localRollupsDir))
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if t, ok := parseFileTime(entry.Name(), localRollupsExt); ok && !t.Before(start) && t.Before(end) {
+			inRange[t.Unix()] = true
+		}
+	}
+	starts := make([]int64, 0, len(inRange))
+	for periodStart, ok := range inRange {
+		if ok {
+			starts = append(starts, periodStart)
+		}
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+
+	result := []Rollup{}
+	for _, periodStart := range starts {
+		rollups, ok := sink.rollups[periodStart]
+		if !ok {
+			if rollups, err = sink.readRollups(periodStart); err != nil {
+				return nil, err
+			}
+		}
+		for _, rollup := range sink.sortedRollups(rollups) {
+			if rollup.Measurement == measurement {
+				result = append(result, rollup)
+			}
+		}
+	}
+	return result, nil
+}
+
+func isDownSamplingMeasurement(measurement string) bool {
+	for _, sampling := range downSamplings {
+		if sampling.Measurement == measurement {
+			return true
+		}
+	}
+	return false
+}
+
+func (sink *localSink) Close() error {
+	sink.Lock()
+	defer sink.Unlock()
+	return sink.saveRollups()
+}
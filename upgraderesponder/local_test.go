@@ -0,0 +1,244 @@
+package upgraderesponder
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocalSink(t *testing.T) {
+	start := time.Date(2026, 10, 16, 13, 0, 0, 0, time.UTC)
+	ca := &Location{}
+	ca.Country.ISOCode = "CA"
+	records := []RequestRecord{
+		{Time: start.Add(5 * time.Minute), AppVersion: "1.2.3", Location: ca},
+		{Time: start.Add(10 * time.Minute), AppVersion: "1.2.3"},
+		{Time: start.Add(70 * time.Minute), AppVersion: "2.3.4", Location: ca},
+	}
+
+	t.Run("should roll records up by period like the continuous queries", func(t *testing.T) {
+		sink, err := newLocalSink(LocalStorageOptions{Dir: t.TempDir()})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := sink.Write(records); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		rollups, err := sink.Rollups(InfluxDBMeasurementDownSampling, start, start.Add(24*time.Hour))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(rollups) != 2 || rollups[0].Total != 2 || rollups[1].Total != 1 || !rollups[1].Time.Equal(start.Add(time.Hour)) {
+			t.Errorf("unexpected rollups %+v", rollups)
+		}
+
+		rollups, err = sink.Rollups(InfluxDBMeasurementByCountryCode, start, start.Add(time.Hour))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(rollups) != 2 || rollups[0].Tags[InfluxDBTagLocationCountryISOCode] != "" || rollups[1].Tags[InfluxDBTagLocationCountryISOCode] != "CA" {
+			t.Errorf("unexpected rollups %+v", rollups)
+		}
+	})
+
+	t.Run("should store no record if one of the files cannot be written", func(t *testing.T) {
+		dir := t.TempDir()
+		sink, err := newLocalSink(LocalStorageOptions{Dir: dir})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		// The records of the second hour cannot be appended to a directory.
+		blocked := filepath.Join(dir, localRecordsDir, start.Add(time.Hour).Format(localFileTimeFormat)+localRecordsExt)
+		if err := os.Mkdir(blocked, 0755); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := sink.Write(records); err == nil {
+			t.Fatalf("expected error")
+		}
+		first := filepath.Join(dir, localRecordsDir, start.Format(localFileTimeFormat)+localRecordsExt)
+		if _, err := os.Stat(first); !os.IsNotExist(err) {
+			t.Errorf("records of the first hour were kept after the failure: %v", err)
+		}
+
+		if err := os.Remove(blocked); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := sink.Write(records); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		content, err := os.ReadFile(first)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if lines := strings.Count(string(content), "\n"); lines != 2 {
+			t.Errorf("expected 2 records in the first hour after the retry, got %d", lines)
+		}
+	})
+
+	t.Run("should load the rollups and keep the records when reopened", func(t *testing.T) {
+		dir := t.TempDir()
+		sink, err := newLocalSink(LocalStorageOptions{Dir: dir})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := sink.Write(records); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := sink.Close(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		sink, err = newLocalSink(LocalStorageOptions{Dir: dir})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		rollups, err := sink.Rollups(InfluxDBMeasurementByAppVersion, start, start.Add(24*time.Hour))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(rollups) != 2 || rollups[0].Tags[InfluxDBTagAppVersion] != "1.2.3" || rollups[0].Total != 2 {
+			t.Errorf("unexpected rollups %+v", rollups)
+		}
+
+		content, err := os.ReadFile(filepath.Join(dir, localRecordsDir, "20261016T130000Z"+localRecordsExt))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if lines := strings.Count(string(content), "\n"); lines != 2 {
+			t.Errorf("unexpected number of records %d", lines)
+		}
+	})
+
+	t.Run("should remove records and rollups older than the retention", func(t *testing.T) {
+		dir := t.TempDir()
+		sink, err := newLocalSink(LocalStorageOptions{Dir: dir, Retention: 90 * time.Minute})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		sink.now = func() time.Time { return start.Add(150 * time.Minute) }
+		if err := sink.Write(records); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		rollups, err := sink.Rollups(InfluxDBMeasurementDownSampling, time.Time{}, start.Add(24*time.Hour))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(rollups) != 1 || !rollups[0].Time.Equal(start.Add(time.Hour)) {
+			t.Errorf("unexpected rollups %+v", rollups)
+		}
+		for _, subdir := range []string{localRecordsDir, localRollupsDir} {
+			entries, err := os.ReadDir(filepath.Join(dir, subdir))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(entries) != 1 || !strings.HasPrefix(entries[0].Name(), "20261016T140000Z") {
+				t.Errorf("unexpected files %v in %v", entries, subdir)
+			}
+		}
+	})
+
+	t.Run("should only keep the rollups of the open periods in memory", func(t *testing.T) {
+		sink, err := newLocalSink(LocalStorageOptions{Dir: t.TempDir()})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		sink.now = func() time.Time { return start.Add(90 * time.Minute) }
+		if err := sink.Write(records); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, ok := sink.rollups[start.Unix()]; ok || len(sink.rollups) != 1 {
+			t.Errorf("unexpected periods in memory %v", sink.rollups)
+		}
+
+		// The records of the period that ended are added to its file.
+		if err := sink.Write(records[:1]); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		rollups, err := sink.Rollups(InfluxDBMeasurementDownSampling, start, start.Add(24*time.Hour))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(rollups) != 2 || rollups[0].Total != 3 || rollups[1].Total != 1 {
+			t.Errorf("unexpected rollups %+v", rollups)
+		}
+		if len(sink.rollups) != 1 {
+			t.Errorf("unexpected periods in memory %v", sink.rollups)
+		}
+	})
+
+	t.Run("should only look for expired files once per hour", func(t *testing.T) {
+		dir := t.TempDir()
+		sink, err := newLocalSink(LocalStorageOptions{Dir: dir, Retention: time.Hour})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		now := start.Add(5 * time.Hour)
+		sink.now = func() time.Time { return now }
+		if err := sink.Write(records[:1]); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		expired := filepath.Join(dir, localRecordsDir, start.Add(2*time.Hour).Format(localFileTimeFormat)+localRecordsExt)
+		if err := os.WriteFile(expired, nil, 0644); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		now = now.Add(30 * time.Minute)
+		if err := sink.Write(records[:1]); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := os.Stat(expired); err != nil {
+			t.Errorf("expired records were looked for twice in the same hour: %v", err)
+		}
+		now = now.Add(time.Hour)
+		if err := sink.Write(records[:1]); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := os.Stat(expired); !os.IsNotExist(err) {
+			t.Errorf("expired records were not removed in the next hour: %v", err)
+		}
+	})
+
+	t.Run("should reject unknown measurements", func(t *testing.T) {
+		sink, err := newLocalSink(LocalStorageOptions{Dir: t.TempDir()})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := sink.Rollups(InfluxDBMeasurement, start, start.Add(time.Hour)); err == nil {
+			t.Errorf("expected error")
+		}
+	})
+
+	t.Run("QueryRollups should respond with the rollups in the requested range", func(t *testing.T) {
+		sink, err := newLocalSink(LocalStorageOptions{Dir: t.TempDir()})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := sink.Write(records); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		server := &Server{rollups: sink}
+
+		recorder := httptest.NewRecorder()
+		url := "/v1/rollups?measurement=" + InfluxDBMeasurementDownSampling + "&start=2026-10-16T14:00:00Z"
+		server.QueryRollups(recorder, httptest.NewRequest("GET", url, nil))
+		var resp RollupsResponse
+		if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(resp.Rollups) != 1 || resp.Rollups[0].Total != 1 {
+			t.Errorf("unexpected response %s", recorder.Body.String())
+		}
+
+		recorder = httptest.NewRecorder()
+		server.QueryRollups(recorder, httptest.NewRequest("GET", "/v1/rollups?measurement=foo", nil))
+		if recorder.Code != 400 {
+			t.Errorf("unexpected status %d", recorder.Code)
+		}
+	})
+}
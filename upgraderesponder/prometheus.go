@@ -0,0 +1,182 @@
+package upgraderesponder
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	PrometheusMetricUpgradeRequest = "upgrade_responder_upgrade_request_total"
+	PrometheusMetricByAppVersion   = "upgrade_responder_upgrade_request_by_app_version_total"
+	PrometheusMetricByCountryCode  = "upgrade_responder_upgrade_request_by_country_code_total"
+	PrometheusMetricByASN          = "upgrade_responder_upgrade_request_by_asn_total"
+
+	PrometheusLabelPlatform = "platform"
+	PrometheusLabelArch     = "arch"
+	PrometheusLabelRule     = "rule"
+
+	// The value of the rule label of requests no Rule applied to.
+	PrometheusRuleNone = "none"
+	// The value of every label of the sample that the requests are counted
+	// in once a counter has PrometheusMaxLabelSets samples.
+	PrometheusLabelValueOther = "other"
+
+	// The maximum number of samples of each counter. Clients control the
+	// label values, so the number of samples is capped to bound memory
+	// use and the size of the metrics.
+	PrometheusMaxLabelSets = 10000
+
+	prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// prometheusCounter is a counter family whose samples are keyed by the
+// values of its labels, in the order of labels.
+type prometheusCounter struct {
+	name   string
+	help   string
+	labels []string
+	values map[string]uint64
+}
+
+// prometheusSink counts RequestRecords and exposes the counts to Prometheus
+// over HTTP. The counters mirror the continuous queries created in
+// InfluxDB 1.x: every request, by app version, by country code and by
+// autonomous system.
+type prometheusSink struct {
+	sync.Mutex
+	counters []*prometheusCounter
+	// The maximum number of samples of each counter.
+	maxLabelSets int
+}
+
+func newPrometheusSink() *prometheusSink {
+	return &prometheusSink{
+		maxLabelSets: PrometheusMaxLabelSets,
+		counters: []*prometheusCounter{
+			{
+				name: PrometheusMetricUpgradeRequest,
+				help: "Number of check upgrade requests.",
+				labels: []string{InfluxDBTagAppVersion, InfluxDBTagLocationCountryISOCode,
+					PrometheusLabelPlatform, PrometheusLabelArch, PrometheusLabelRule},
+				values: map[string]uint64{},
+			},
+			{
+				name:   PrometheusMetricByAppVersion,
+				help:   "Number of check upgrade requests by app version.",
+				labels: []string{InfluxDBTagAppVersion},
+				values: map[string]uint64{},
+			},
+			{
+				name:   PrometheusMetricByCountryCode,
+				help:   "Number of check upgrade requests by country code.",
+				labels: []string{InfluxDBTagLocationCountryISOCode},
+				values: map[string]uint64{},
+			},
+			{
+				name:   PrometheusMetricByASN,
+				help:   "Number of check upgrade requests by autonomous system.",
+				labels: []string{InfluxDBTagASN, InfluxDBTagASOrganization},
+				values: map[string]uint64{},
+			},
+		},
+	}
+}
+
+// prometheusLabels returns the values of every label used by the counters
+// for a record. Unknown values are empty, as in the InfluxDB tags.
+func prometheusLabels(record RequestRecord) map[string]string {
+	labels := map[string]string{
+		InfluxDBTagAppVersion: record.AppVersion,
+		PrometheusLabelRule:   PrometheusRuleNone,
+	}
+	if record.Location != nil {
+		labels[InfluxDBTagLocationCountryISOCode] = record.Location.Country.ISOCode
+		if record.Location.ASN != 0 {
+			labels[InfluxDBTagASN] = strconv.FormatUint(uint64(record.Location.ASN), 10)
+			labels[InfluxDBTagASOrganization] = record.Location.ASOrganization
+		}
+	}
+	// The platform is sent as "<platform>-<arch>".
+	if platformAndArch, ok := record.ExtraInfo["platform"]; ok {
+		components := strings.SplitN(platformAndArch, "-", 2)
+		labels[PrometheusLabelPlatform] = components[0]
+		if len(components) > 1 {
+			labels[PrometheusLabelArch] = components[1]
+		}
+	}
+	if record.RuleIndex >= 0 {
+		labels[PrometheusLabelRule] = strconv.Itoa(record.RuleIndex)
+	}
+	return labels
+}
+
+func (sink *prometheusSink) Write(records []RequestRecord) error {
+	sink.Lock()
+	defer sink.Unlock()
+	for _, record := range records {
+		labels := prometheusLabels(record)
+		for _, counter := range sink.counters {
+			key := counter.key(labels)
+			if _, ok := counter.values[key]; !ok && len(counter.values) >= sink.maxLabelSets {
+				key = counter.otherKey()
+			}
+			counter.values[key] += uint64(record.Requests())
+		}
+	}
+	return nil
+}
+
+// key returns the key of the sample of counter for the given label values.
+func (counter *prometheusCounter) key(labels map[string]string) string {
+	pairs := make([]string, len(counter.labels))
+	for i, label := range counter.labels {
+		pairs[i] = fmt.Sprintf(`%v="%v"`, label, prometheusLabelValueEscaper.Replace(labels[label]))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// otherKey returns the key of the sample in which the requests that do not
+// fit in the other samples of counter are counted.
+func (counter *prometheusCounter) otherKey() string {
+	labels := make(map[string]string, len(counter.labels))
+	for _, label := range counter.labels {
+		labels[label] = PrometheusLabelValueOther
+	}
+	return counter.key(labels)
+}
+
+func (sink *prometheusSink) Close() error {
+	return nil
+}
+
+// ServeHTTP writes the counters in the Prometheus text exposition format.
+func (sink *prometheusSink) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", prometheusContentType)
+	sink.writeTo(rw)
+}
+
+func (sink *prometheusSink) writeTo(w io.Writer) {
+	sink.Lock()
+	defer sink.Unlock()
+	for _, counter := range sink.counters {
+		fmt.Fprintf(w, "# HELP %v %v\n", counter.name, counter.help)
+		fmt.Fprintf(w, "# TYPE %v counter\n", counter.name)
+		keys := make([]string, 0, len(counter.values))
+		for key := range counter.values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(w, "%v{%v} %v\n", counter.name, key, counter.values[key])
+		}
+	}
+}
+
+// prometheusLabelValueEscaper escapes label values as required by the text
+// exposition format.
+var prometheusLabelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
@@ -0,0 +1,97 @@
+package upgraderesponder
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPrometheusSink(t *testing.T) {
+	t.Run("should expose the counts of the records written", func(t *testing.T) {
+		loc := &Location{}
+		loc.Country.ISOCode = "CA"
+		sink := newPrometheusSink()
+		records := []RequestRecord{
+			{AppVersion: "1.2.3", ExtraInfo: map[string]string{"platform": "darwin-x64"}, Location: loc, RuleIndex: 0},
+			{AppVersion: "1.2.3", ExtraInfo: map[string]string{"platform": "darwin-x64"}, Location: loc, RuleIndex: 0},
+			{AppVersion: "2.3.4", RuleIndex: -1},
+		}
+		if err := sink.Write(records); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		recorder := httptest.NewRecorder()
+		sink.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+		if contentType := recorder.Header().Get("Content-Type"); contentType != prometheusContentType {
+			t.Errorf("unexpected Content-Type %q", contentType)
+		}
+		for _, expected := range []string{
+			"# TYPE upgrade_responder_upgrade_request_total counter\n",
+			`upgrade_responder_upgrade_request_total{app_version="1.2.3",country_isocode="CA",platform="darwin",arch="x64",rule="0"} 2` + "\n",
+			`upgrade_responder_upgrade_request_total{app_version="2.3.4",country_isocode="",platform="",arch="",rule="none"} 1` + "\n",
+			`upgrade_responder_upgrade_request_by_app_version_total{app_version="1.2.3"} 2` + "\n",
+			`upgrade_responder_upgrade_request_by_country_code_total{country_isocode=""} 1` + "\n",
+			`upgrade_responder_upgrade_request_by_country_code_total{country_isocode="CA"} 2` + "\n",
+		} {
+			if !strings.Contains(recorder.Body.String(), expected) {
+				t.Errorf("metrics %s do not contain %s", recorder.Body.String(), expected)
+			}
+		}
+	})
+
+	t.Run("should count the requests by autonomous system", func(t *testing.T) {
+		loc := &Location{ASN: 13335, ASOrganization: "CLOUDFLARENET"}
+		sink := newPrometheusSink()
+		if err := sink.Write([]RequestRecord{{AppVersion: "1.2.3", Location: loc, RuleIndex: -1}}); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		recorder := httptest.NewRecorder()
+		sink.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+		expected := `upgrade_responder_upgrade_request_by_asn_total{asn="13335",as_organization="CLOUDFLARENET"} 1`
+		if !strings.Contains(recorder.Body.String(), expected) {
+			t.Errorf("metrics %s do not contain %s", recorder.Body.String(), expected)
+		}
+	})
+
+	t.Run("should escape label values", func(t *testing.T) {
+		sink := newPrometheusSink()
+		if err := sink.Write([]RequestRecord{{AppVersion: "a\"b\\c\nd", RuleIndex: -1}}); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		recorder := httptest.NewRecorder()
+		sink.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+		expected := `upgrade_responder_upgrade_request_by_app_version_total{app_version="a\"b\\c\nd"} 1`
+		if !strings.Contains(recorder.Body.String(), expected) {
+			t.Errorf("metrics %s do not contain %s", recorder.Body.String(), expected)
+		}
+	})
+
+	t.Run("should count the requests beyond the maximum number of label sets as other", func(t *testing.T) {
+		sink := newPrometheusSink()
+		sink.maxLabelSets = 2
+		records := []RequestRecord{
+			{AppVersion: "1.0.0", RuleIndex: -1},
+			{AppVersion: "2.0.0", RuleIndex: -1},
+			{AppVersion: "3.0.0", RuleIndex: -1},
+			{AppVersion: "4.0.0", RuleIndex: -1},
+			{AppVersion: "1.0.0", RuleIndex: -1},
+		}
+		if err := sink.Write(records); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		recorder := httptest.NewRecorder()
+		sink.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+		for _, expected := range []string{
+			`upgrade_responder_upgrade_request_by_app_version_total{app_version="1.0.0"} 2` + "\n",
+			`upgrade_responder_upgrade_request_by_app_version_total{app_version="2.0.0"} 1` + "\n",
+			`upgrade_responder_upgrade_request_by_app_version_total{app_version="other"} 2` + "\n",
+		} {
+			if !strings.Contains(recorder.Body.String(), expected) {
+				t.Errorf("metrics %s do not contain %s", recorder.Body.String(), expected)
+			}
+		}
+		if strings.Contains(recorder.Body.String(), `app_version="3.0.0"`) {
+			t.Errorf("metrics %s contain more label sets than the maximum", recorder.Body.String())
+		}
+	})
+}
@@ -9,6 +9,12 @@ func NewRouter(s *Server) *mux.Router {
 
 	r.Methods("POST").Path("/v1/checkupgrade").HandlerFunc(s.CheckUpgrade)
 	r.Methods("GET").Path("/v1/healthcheck").HandlerFunc(s.HealthCheck)
+	if s.metricsHandler != nil {
+		r.Methods("GET").Path("/metrics").Handler(s.metricsHandler)
+	}
+	if s.rollups != nil {
+		r.Methods("GET").Path("/v1/rollups").HandlerFunc(s.QueryRollups)
+	}
 
 	return r
 }
@@ -1,19 +1,20 @@
 package upgraderesponder
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/Masterminds/semver/v3"
 	"github.com/Sirupsen/logrus"
-	influxcli "github.com/influxdata/influxdb/client/v2"
-	maxminddb "github.com/oschwald/maxminddb-golang"
 	"github.com/pkg/errors"
 
 	rd "github.com/longhorn/upgrade-responder/rancherdesktop"
-	"github.com/longhorn/upgrade-responder/utils"
 )
 
 const (
@@ -23,10 +24,12 @@ const (
 	InfluxDBMeasurementDownSampling  = "upgrade_request_down_sampling"
 	InfluxDBMeasurementByAppVersion  = "by_app_version_down_sampling"
 	InfluxDBMeasurementByCountryCode = "by_country_code_down_sampling"
+	InfluxDBMeasurementByASN         = "by_asn_down_sampling"
 
 	InfluxDBContinuousQueryDownSampling  = "cq_upgrade_request_down_sampling"
 	InfluxDBContinuousQueryByAppVersion  = "cq_by_app_version_down_sampling"
 	InfluxDBContinuousQueryByCountryCode = "cq_by_country_code_down_sampling"
+	InfluxDBContinuousQueryByASN         = "cq_by_asn_down_sampling"
 )
 
 var (
@@ -39,23 +42,69 @@ var (
 	InfluxDBTagLocationCity           = "city"
 	InfluxDBTagLocationCountry        = "country"
 	InfluxDBTagLocationCountryISOCode = "country_isocode"
+	InfluxDBTagLocationContinent      = "continent"
+	InfluxDBTagASN                    = "asn"
+	InfluxDBTagASOrganization         = "as_organization"
 
 	HTTPHeaderXForwardedFor = "X-Forwarded-For"
 	ValueFieldKey           = "value" // A dummy InfluxDB field used to count the number of points
 	ValueFieldValue         = 1
+	CountFieldKey           = "count" // The number of requests of an aggregated point
 )
 
 type Server struct {
-	done chan struct{}
+	done       chan struct{}
+	configFile string
+	// Holds the *responseState built from the current response config.
+	// It is replaced as a whole on reload, so that a request never sees
+	// a partially updated set of rules and versions.
+	state        atomic.Value
+	configLock   sync.Mutex
+	configStatus ConfigStatus
+	geo          GeoResolver
+	// The proxies whose forwarding headers are believed. See clientIP.
+	trustedProxies []*net.IPNet
+	// Nil if requests are not recorded.
+	sink    Sink
+	dbCache *DBCache
+	// Closed to stop dbCache, which closes cacheDone once it has written
+	// the pending records.
+	cacheStop chan struct{}
+	cacheDone chan struct{}
+	// Serves the metrics of the backend, if it exposes them over HTTP.
+	metricsHandler http.Handler
+	// Nil if the backend does not roll requests up by itself.
+	rollups rollupSource
+}
+
+// responseState is everything derived from a ResponseConfig that is
+// needed to respond to a CheckUpgradeRequest.
+type responseState struct {
 	// The set of versions that is returned when the client does
 	// not include the information required to make an InstanceInfo.
 	DefaultVersions []rd.Version
 	// Maps Rules to a slice of versions with Version.Supported
 	// precomputed according to Rule.Constraints.
 	PrecomputedVersions []PrecomputedVersion
-	influxClient        influxcli.Client
-	db                  *maxminddb.Reader
-	dbCache             *DBCache
+	// The config the state was derived from.
+	Config rd.ResponseConfig
+}
+
+// ConfigStatus describes the outcome of loading the response config.
+// It is reported by the health check endpoint.
+type ConfigStatus struct {
+	File          string    `json:"file"`
+	LoadedAt      time.Time `json:"loadedAt"`
+	LastAttemptAt time.Time `json:"lastAttemptAt"`
+	// The error encountered by the last attempt to reload the config,
+	// if any. The previously loaded config stays in use in that case.
+	LastError string `json:"lastError,omitempty"`
+}
+
+type HealthCheckResponse struct {
+	Config ConfigStatus `json:"config"`
+	// Nil if requests are not recorded.
+	Recording *DBCacheStats `json:"recording,omitempty"`
 }
 
 // PrecomputedVersion is used as a "mapping" from a Rule to the set of
@@ -73,137 +122,252 @@ type Location struct {
 		Name    string
 		ISOCode string
 	} `json:"country"`
+	// The two-letter code of the continent, such as EU.
+	Continent string `json:"continent,omitempty"`
+	// The autonomous system the IP belongs to, if an ASN database is
+	// configured and knows the IP.
+	ASN            uint   `json:"asn,omitempty"`
+	ASOrganization string `json:"asOrganization,omitempty"`
+}
+
+type RollupsResponse struct {
+	Rollups []Rollup `json:"rollups"`
 }
 
 type CheckUpgradeResponse struct {
 	Versions                 []rd.Version `json:"versions"`
 	RequestIntervalInMinutes int          `json:"requestIntervalInMinutes"`
+	// True if the version of the client is older than the
+	// MinimumSupportedVersion of the config.
+	CurrentVersionEndOfLife bool `json:"currentVersionEndOfLife,omitempty"`
+	// True if the version of the client is end-of-life, or if a newer
+	// supported version with SeverityCritical is offered to it.
+	UpgradeRequired bool `json:"upgradeRequired,omitempty"`
+	// The Name of the version the client should upgrade to, if any. See
+	// rd.Recommended.
+	Recommended string `json:"recommended,omitempty"`
+}
+
+// ServerOptions configures a Server.
+type ServerOptions struct {
+	// Used to name the database that requests are recorded to.
+	ApplicationName      string
+	ConfigFile           string
+	ConfigReloadInterval time.Duration
+	// How often each instance of the application makes a request.
+	QueryPeriod string
+	// Selects how the locations of requests are resolved. See
+	// newGeoResolver.
+	GeoResolver string
+	GeoDB       string
+	// Optional GeoLite2-ASN database, used to record the autonomous system
+	// of requests.
+	ASNDB string
+	// How often GeoDB and ASNDB are checked for changes. Zero disables
+	// reloading.
+	GeoDBReloadInterval time.Duration
+	// The CIDR to country file of the csv GeoResolver.
+	GeoCSV string
+	// CIDRs or IP addresses of the proxies in front of the server. See
+	// clientIP.
+	TrustedProxies    []string
+	CacheSyncInterval time.Duration
+	CacheSize         int
+	CacheQueueSize    int
+	// Write one record per tag set and query period, counting the
+	// requests, instead of one record per request.
+	AggregateRequests bool
+	// Selects where requests are recorded. See newSink.
+	MetricsBackend string
+	InfluxDB       InfluxDBOptions
+	LocalStorage   LocalStorageOptions
+	Spool          SpoolOptions
 }
 
-func NewServer(done chan struct{}, applicationName, configFile, influxURL, influxUser, influxPass, queryPeriod, geodb string, cacheSyncInterval, cacheSize int) (*Server, error) {
-	InfluxDBDatabase = applicationName + "_" + InfluxDBDatabase
-	InfluxDBContinuousQueryPeriod = queryPeriod
+func NewServer(done chan struct{}, options ServerOptions) (*Server, error) {
+	InfluxDBDatabase = options.ApplicationName + "_" + InfluxDBDatabase
+	InfluxDBContinuousQueryPeriod = options.QueryPeriod
 
-	config, err := rd.ReadConfig(configFile)
+	trustedProxies, err := ParseTrustedProxies(options.TrustedProxies)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read config: %w", err)
+		return nil, err
 	}
-
 	s := &Server{
-		done:            done,
-		DefaultVersions: config.Versions,
+		done:           done,
+		configFile:     options.ConfigFile,
+		trustedProxies: trustedProxies,
+	}
+	if err := s.ReloadConfig(); err != nil {
+		return nil, err
 	}
-	if err := s.generatePrecomputedVersions(config); err != nil {
-		return nil, fmt.Errorf("failed to generate precomputed versions: %w", err)
+	if options.ConfigReloadInterval > 0 {
+		go s.watchConfig(done, options.ConfigReloadInterval)
 	}
 
-	db, err := maxminddb.Open(geodb)
+	geo, err := newGeoResolver(options)
 	if err != nil {
-		return nil, errors.Wrap(err, "fail to open geodb file")
+		return nil, err
+	}
+	s.geo = geo
+	if watcher, ok := geo.(geoWatcher); ok && options.GeoDBReloadInterval > 0 {
+		go watcher.watch(done, options.GeoDBReloadInterval)
 	}
-	s.db = db
-	logrus.Debugf("GeoDB opened")
 
-	if influxURL != "" {
-		cfg := influxcli.HTTPConfig{
-			Addr:               influxURL,
-			InsecureSkipVerify: true,
-		}
-		if influxUser != "" {
-			cfg.Username = influxUser
-		}
-		if influxPass != "" {
-			cfg.Password = influxPass
-		}
-		c, err := influxcli.NewHTTPClient(cfg)
+	sink, err := newSink(options)
+	if err != nil {
+		return nil, err
+	}
+	if handler, ok := sink.(http.Handler); ok {
+		s.metricsHandler = handler
+	}
+	if rollups, ok := sink.(rollupSource); ok {
+		s.rollups = rollups
+	}
+	if sink != nil {
+		dbCache, err := NewDBCache(options.CacheSyncInterval, options.CacheSize, options.CacheQueueSize, sink)
 		if err != nil {
 			return nil, err
 		}
-		logrus.Debugf("InfluxDB connection established")
-
-		s.influxClient = c
-		if err := s.initDB(); err != nil {
-			return nil, err
-		}
-	}
-	go func() {
-		<-done
-		if err := s.db.Close(); err != nil {
-			logrus.Debugf("Failed to close geodb: %v", err)
-		} else {
-			logrus.Debugf("Geodb connection closed")
+		if options.AggregateRequests {
+			period, err := time.ParseDuration(InfluxDBContinuousQueryPeriod)
+			if err != nil {
+				return nil, errors.Wrap(err, "fail to parse query period")
+			}
+			dbCache.AggregationPeriod = period
 		}
-		if s.influxClient != nil {
-			if err := s.influxClient.Close(); err != nil {
-				logrus.Debugf("Failed to close InfluxDB connection: %v", err)
-			} else {
-				logrus.Debug("InfluxDB connection closed")
+		if options.Spool.Dir != "" {
+			spool, err := NewSpool(options.Spool)
+			if err != nil {
+				return nil, errors.Wrap(err, "fail to open spool")
 			}
+			dbCache.Spool = spool
 		}
-	}()
-
-	dbCache, err := NewDBCache(InfluxDBDatabase, InfluxDBPrecisionNanosecond, time.Duration(cacheSyncInterval)*time.Second, cacheSize, s.influxClient)
-	if err != nil {
-		return nil, err
+		s.startRecording(sink, dbCache)
 	}
-	s.dbCache = dbCache
-	go s.dbCache.Run(done)
 
 	return s, nil
 }
 
-func (s *Server) initDB() error {
-	if err := s.createDB(InfluxDBDatabase); err != nil {
-		return err
+// startRecording starts writing the records added to dbCache to sink, until
+// Shutdown is called.
+func (s *Server) startRecording(sink Sink, dbCache *DBCache) {
+	s.sink = sink
+	s.dbCache = dbCache
+	s.cacheStop = make(chan struct{})
+	s.cacheDone = make(chan struct{})
+	go func() {
+		defer close(s.cacheDone)
+		s.dbCache.Run(s.cacheStop)
+	}()
+}
+
+// Shutdown closes the geo resolver, writes the requests that are not
+// recorded yet, and then closes the metrics backend. It must only be called
+// once the server no longer handles requests. If ctx expires before the
+// requests are written, the metrics backend is left open, since it may
+// still be in use.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if err := s.geo.Close(); err != nil {
+		logrus.Debugf("Failed to close geo resolver: %v", err)
+	}
+	if s.dbCache != nil {
+		close(s.cacheStop)
+		select {
+		case <-s.cacheDone:
+			logrus.Debug("Pending requests recorded")
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "fail to record pending requests")
+		}
 	}
-	if err := s.createContinuousQueries(InfluxDBDatabase); err != nil {
+	if s.sink != nil {
+		if err := s.sink.Close(); err != nil {
+			logrus.Debugf("Failed to close metrics backend: %v", err)
+		} else {
+			logrus.Debug("Metrics backend closed")
+		}
+	}
+	return nil
+}
+
+// ReloadConfig reads and validates the response config file, and then
+// replaces the config used to respond to requests. If the file cannot be
+// read or is invalid, the config that is currently in use is kept.
+func (s *Server) ReloadConfig() error {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	now := time.Now()
+	s.configStatus.File = s.configFile
+	s.configStatus.LastAttemptAt = now
+
+	err := s.loadConfigFile()
+	if err != nil {
+		s.configStatus.LastError = err.Error()
 		return err
 	}
+	s.configStatus.LoadedAt = now
+	s.configStatus.LastError = ""
 	return nil
 }
 
-func (s *Server) createDB(name string) error {
-	q := influxcli.NewQuery("CREATE DATABASE "+name, "", "")
-	response, err := s.influxClient.Query(q)
+func (s *Server) loadConfigFile() error {
+	config, err := rd.ReadConfig(s.configFile)
 	if err != nil {
+		return fmt.Errorf("failed to read config: %w", err)
+	}
+	if err := s.setConfig(config); err != nil {
 		return err
 	}
-	if response.Error() != nil {
-		return response.Error()
+	for _, warning := range config.AnalyzeRules() {
+		logrus.Warnf("Config file %v: %v", s.configFile, warning)
 	}
-	logrus.Debugf("Database %v is either created or already exists", name)
 	return nil
 }
 
-func (s *Server) createContinuousQueries(dbName string) error {
-	queryStrings := map[string]string{}
-
-	queryStrings[InfluxDBContinuousQueryDownSampling] = fmt.Sprintf("CREATE CONTINUOUS QUERY %v ON %v BEGIN SELECT count(%v) as total INTO %v FROM %v GROUP BY time(%v) END",
-		InfluxDBContinuousQueryDownSampling, dbName, utils.ToSnakeCase(ValueFieldKey), InfluxDBMeasurementDownSampling, InfluxDBMeasurement, InfluxDBContinuousQueryPeriod)
-	queryStrings[InfluxDBContinuousQueryByAppVersion] = fmt.Sprintf("CREATE CONTINUOUS QUERY %v ON %v BEGIN SELECT count(%v) as total INTO %v FROM %v GROUP BY time(%v),%v END",
-		InfluxDBContinuousQueryByAppVersion, dbName, utils.ToSnakeCase(ValueFieldKey), InfluxDBMeasurementByAppVersion, InfluxDBMeasurement, InfluxDBContinuousQueryPeriod, InfluxDBTagAppVersion)
-	queryStrings[InfluxDBContinuousQueryByCountryCode] = fmt.Sprintf("CREATE CONTINUOUS QUERY %v ON %v BEGIN SELECT count(%v) as total INTO %v FROM %v GROUP BY time(%v),%v END",
-		InfluxDBContinuousQueryByCountryCode, dbName, utils.ToSnakeCase(ValueFieldKey), InfluxDBMeasurementByCountryCode, InfluxDBMeasurement, InfluxDBContinuousQueryPeriod, InfluxDBTagLocationCountryISOCode)
-
-	for queryName, queryString := range queryStrings {
-		query := influxcli.NewQuery(queryString, "", "")
-		response, err := s.influxClient.Query(query)
-		if err != nil {
-			return err
-		}
-		if err := response.Error(); err != nil {
-			if utils.IsAlreadyExistsError(err) {
-				logrus.Debugf("The continuous query %v is already exists and cannot be modified. If you modified --query-period, please manually drop the continuous query %v from the database %v and retry", queryName, queryName, dbName)
-			}
-			return err
-		}
-		logrus.Debugf("Created continuous query %v", queryName)
+// setConfig builds a new responseState from config and swaps it in.
+func (s *Server) setConfig(config rd.ResponseConfig) error {
+	precomputedVersions, err := generatePrecomputedVersions(config)
+	if err != nil {
+		return fmt.Errorf("failed to generate precomputed versions: %w", err)
 	}
+	s.state.Store(newResponseState(config, precomputedVersions))
 	return nil
 }
 
+func newResponseState(config rd.ResponseConfig, precomputedVersions []PrecomputedVersion) *responseState {
+	return &responseState{
+		DefaultVersions:     config.Versions,
+		PrecomputedVersions: precomputedVersions,
+		Config:              config,
+	}
+}
+
+func (s *Server) getState() *responseState {
+	return s.state.Load().(*responseState)
+}
+
+// ConfigStatus returns the outcome of the most recent attempt to load
+// the response config.
+func (s *Server) ConfigStatus() ConfigStatus {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+	return s.configStatus
+}
+
 func (s *Server) HealthCheck(rw http.ResponseWriter, req *http.Request) {
-	rw.WriteHeader(http.StatusOK)
+	// A config that failed to reload does not make the server unhealthy,
+	// since it keeps responding with the previous config. It is reported
+	// in the response body so that it can be noticed.
+	resp := HealthCheckResponse{
+		Config: s.ConfigStatus(),
+	}
+	if s.dbCache != nil {
+		stats := s.dbCache.Stats()
+		resp.Recording = &stats
+	}
+	if err := respondWithJSON(rw, resp); err != nil {
+		logrus.Errorf("Failed to repsondWithJSON: %v", err)
+	}
 }
 
 func (s *Server) CheckUpgrade(rw http.ResponseWriter, req *http.Request) {
@@ -223,13 +387,11 @@ func (s *Server) CheckUpgrade(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	s.recordRequest(req, &checkReq)
+	now := time.Now()
+	loc := s.resolveLocation(req)
+	checkResp, eval := s.getState().respond(checkReq, loc.countryISOCode(), now)
 
-	checkResp, err = s.GenerateCheckUpgradeResponse(checkReq)
-	if err != nil {
-		logrus.Errorf("Failed to GenerateCheckUpgradeResponse: %v", err)
-		return
-	}
+	s.recordRequest(&checkReq, loc, now, eval)
 
 	if err = respondWithJSON(rw, checkResp); err != nil {
 		logrus.Errorf("Failed to repsondWithJSON: %v", err)
@@ -238,6 +400,37 @@ func (s *Server) CheckUpgrade(rw http.ResponseWriter, req *http.Request) {
 	return
 }
 
+// QueryRollups responds with the rollups of the measurement given in the
+// query, for the periods starting between the optional start and end
+// times, formatted as RFC 3339.
+func (s *Server) QueryRollups(rw http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	start := time.Time{}
+	end := time.Now()
+	for _, bound := range []struct {
+		name string
+		t    *time.Time
+	}{{"start", &start}, {"end", &end}} {
+		if value := query.Get(bound.name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				http.Error(rw, fmt.Sprintf("invalid %v: %v", bound.name, err), http.StatusBadRequest)
+				return
+			}
+			*bound.t = t
+		}
+	}
+
+	rollups, err := s.rollups.Rollups(query.Get("measurement"), start, end)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := respondWithJSON(rw, RollupsResponse{Rollups: rollups}); err != nil {
+		logrus.Errorf("Failed to repsondWithJSON: %v", err)
+	}
+}
+
 func respondWithJSON(rw http.ResponseWriter, obj interface{}) error {
 	response, err := json.Marshal(obj)
 	if err != nil {
@@ -250,24 +443,63 @@ func respondWithJSON(rw http.ResponseWriter, obj interface{}) error {
 }
 
 func (s *Server) GenerateCheckUpgradeResponse(request rd.CheckUpgradeRequest) (*CheckUpgradeResponse, error) {
+	resp, _ := s.getState().respond(request, "", time.Now())
+	return resp, nil
+}
+
+// evaluation records how the response to a CheckUpgradeRequest was reached.
+type evaluation struct {
+	// Index of the Rule that applied to the request, or -1 if none did.
+	ruleIndex int
+	// The reason the request could not be parsed as an InstanceInfo, if
+	// it could not. DefaultVersions are used in that case.
+	instanceInfoErr error
+}
+
+// respond builds the response to request, made from the country with the
+// given ISO code at the given time, and returns how it was reached along
+// with it. country is empty if it is unknown.
+func (state *responseState) respond(request rd.CheckUpgradeRequest, country string, now time.Time) (*CheckUpgradeResponse, evaluation) {
 	resp := &CheckUpgradeResponse{}
+	eval := evaluation{ruleIndex: -1}
 
 	instanceInfo, err := rd.NewInstanceInfo(request)
 	if err != nil {
 		logrus.Debugf("could not parse request %+v as InstanceInfo: %s", request, err)
-		resp.Versions = s.DefaultVersions
+		eval.instanceInfoErr = err
+		resp.Versions = state.DefaultVersions
 	} else {
+		instanceInfo.Country = country
 		logrus.Debugf("parsed request into InstanceInfo %+v", request)
-		for _, precomp := range s.PrecomputedVersions {
+		for i, precomp := range state.PrecomputedVersions {
 			if precomp.Rule.AppliesTo(instanceInfo) {
+				eval.ruleIndex = i
 				resp.Versions = precomp.Versions
+				if precomp.Rule.Constraints.DependsOnRequest() {
+					resp.Versions = applyRequestConstraints(resp.Versions, precomp.Rule.Constraints, instanceInfo, now)
+				}
 				break
 			}
 		}
 		if len(resp.Versions) == 0 {
-			resp.Versions = s.DefaultVersions
+			resp.Versions = state.DefaultVersions
 		}
 	}
+	// appVersion is nil if it cannot be parsed.
+	appVersion, _ := semver.NewVersion(request.AppVersion)
+	resp.Versions = applyRetractions(resp.Versions, appVersion)
+	channel := rd.ClientChannel(request)
+	resp.Versions = applyChannel(resp.Versions, channel, appVersion)
+	resp.Versions = applyRollouts(resp.Versions, request.ExtraInfo[rd.ExtraInfoKeyInstanceID], appVersion, now)
+	// The platform is empty if it cannot be parsed.
+	platform, arch, _ := rd.ParsePlatform(request)
+	resp.Versions = applyArtifacts(resp.Versions, platform, arch)
+
+	if appVersion != nil {
+		resp.CurrentVersionEndOfLife = state.Config.EndOfLife(appVersion)
+		resp.UpgradeRequired = resp.CurrentVersionEndOfLife || rd.UpgradeRequired(appVersion, resp.Versions)
+		resp.Recommended = rd.Recommended(appVersion, channel, resp.Versions, state.Config.Versions)
+	}
 
 	d, err := time.ParseDuration(InfluxDBContinuousQueryPeriod)
 	if err != nil {
@@ -277,92 +509,115 @@ func (s *Server) GenerateCheckUpgradeResponse(request rd.CheckUpgradeRequest) (*
 		resp.RequestIntervalInMinutes = int(d.Minutes())
 	}
 
-	return resp, nil
+	return resp, eval
 }
 
-type locationRecord struct {
-	City struct {
-		Names map[string]string `maxminddb:"names"`
-	} `maxminddb:"city"`
-	Country struct {
-		Names   map[string]string `maxminddb:"names"`
-		ISOCode string            `maxminddb:"iso_code"`
-	} `maxminddb:"country"`
+// applyRequestConstraints returns a copy of versions in which the versions
+// that constraints do not support for the client represented by
+// instanceInfo at the given time are unsupported.
+func applyRequestConstraints(versions []rd.Version, constraints rd.Constraints, instanceInfo rd.InstanceInfo, now time.Time) []rd.Version {
+	result := make([]rd.Version, len(versions))
+	for i, version := range versions {
+		if version.Supported {
+			version.Supported = constraints.SupportedFor(version, instanceInfo, now)
+		}
+		result[i] = version
+	}
+	return result
 }
 
-func (s *Server) getLocation(addr string) (*Location, error) {
-	var (
-		record locationRecord
-		loc    Location
-	)
-	ip := net.ParseIP(addr)
+// applyChannel omits the versions that are not offered on channel, except
+// the one that the client runs.
+func applyChannel(versions []rd.Version, channel string, appVersion *semver.Version) []rd.Version {
+	result := make([]rd.Version, 0, len(versions))
+	for _, version := range versions {
+		if version.OfferedOn(channel) || isRunBy(version, appVersion) {
+			result = append(result, version)
+		}
+	}
+	return result
+}
 
-	err := s.db.Lookup(ip, &record)
-	if err != nil {
-		return nil, err
+// applyRetractions omits the retracted versions, except the one that the
+// client runs, if its version could be parsed. That one is kept as an
+// unsupported version so that the client can learn why it was retracted.
+func applyRetractions(versions []rd.Version, appVersion *semver.Version) []rd.Version {
+	result := make([]rd.Version, 0, len(versions))
+	for _, version := range versions {
+		if version.Retracted != nil {
+			if !isRunBy(version, appVersion) {
+				continue
+			}
+			version.Supported = false
+		}
+		result = append(result, version)
 	}
+	return result
+}
 
-	loc.City = record.City.Names["en"]
-	loc.Country.Name = record.Country.Names["en"]
-	loc.Country.ISOCode = record.Country.ISOCode
-	return &loc, nil
+// applyRollouts omits the versions whose Rollout does not include the
+// client identified by instanceID at the given time, except the one that
+// the client runs.
+func applyRollouts(versions []rd.Version, instanceID string, appVersion *semver.Version, now time.Time) []rd.Version {
+	result := make([]rd.Version, 0, len(versions))
+	for _, version := range versions {
+		if version.Rollout != nil {
+			if !version.Rollout.Includes(version.Name, instanceID, now) && !isRunBy(version, appVersion) {
+				continue
+			}
+			// Clients have no use for the details of the rollout.
+			version.Rollout = nil
+		}
+		result = append(result, version)
+	}
+	return result
+}
+
+// isRunBy returns true if version is appVersion, the version that the
+// client runs. The channel and rollout filters keep that version, so that a
+// client running a retracted version always receives it, whatever channel
+// or rollout it was installed from.
+func isRunBy(version rd.Version, appVersion *semver.Version) bool {
+	return appVersion != nil && version.IsRunBy(appVersion)
 }
 
 //func canonializeField(name string) string {
 //	return strings.Replace(strings.ToLower(HTTPHeaderRequestID), "-", "_", -1)
 //}
 
-// Don't need to return error to the requester
-func (s *Server) recordRequest(httpReq *http.Request, req *rd.CheckUpgradeRequest) {
-	xForwaredFor := httpReq.Header[HTTPHeaderXForwardedFor]
-	publicIP := ""
-	l := len(xForwaredFor)
-	if l > 0 {
-		// rightmost IP must be the public IP
-		publicIP = xForwaredFor[l-1]
-	}
-
+// resolveLocation returns the location httpReq came from, or nil if it is
+// unknown. Failures are not returned to the requester.
+func (s *Server) resolveLocation(httpReq *http.Request) *Location {
 	// We use IP to find the location but we don't store IP
-	loc, err := s.getLocation(publicIP)
+	ip := clientIP(httpReq, s.trustedProxies)
+	if ip == nil {
+		return nil
+	}
+	loc, err := s.geo.Resolve(ip)
 	if err != nil {
 		logrus.Error("Failed to get location for one ip")
+		return nil
 	}
+	return loc
+}
 
-	if s.influxClient != nil {
-		var (
-			err error
-			pt  *influxcli.Point
-		)
-		defer func() {
-			if err != nil {
-				logrus.Errorf("Failed to recordRequest: %v", err)
-			}
-		}()
-
-		tags := map[string]string{
-			InfluxDBTagAppVersion: req.AppVersion,
-		}
-		for k, v := range req.ExtraInfo {
-			tags[utils.ToSnakeCase(k)] = v
-		}
-		fields := map[string]interface{}{
-			utils.ToSnakeCase(ValueFieldKey): ValueFieldValue,
-		}
-		if loc != nil {
-			tags[InfluxDBTagLocationCity] = loc.City
-			tags[InfluxDBTagLocationCountry] = loc.Country.Name
-			tags[InfluxDBTagLocationCountryISOCode] = loc.Country.ISOCode
-		}
-		pt, err = influxcli.NewPoint(InfluxDBMeasurement, tags, fields, time.Now())
-		if err != nil {
-			return
-		}
+// countryISOCode returns the ISO code of the country of loc, or an empty
+// string if loc is nil.
+func (loc *Location) countryISOCode() string {
+	if loc == nil {
+		return ""
+	}
+	return loc.Country.ISOCode
+}
 
-		s.dbCache.AddPoint(pt)
+// Don't need to return error to the requester
+func (s *Server) recordRequest(req *rd.CheckUpgradeRequest, loc *Location, now time.Time, eval evaluation) {
+	if s.dbCache != nil {
+		s.dbCache.AddRecord(newRequestRecord(now, *req, loc, eval.ruleIndex))
 	}
 }
 
-func (s *Server) generatePrecomputedVersions(config rd.ResponseConfig) error {
+func generatePrecomputedVersions(config rd.ResponseConfig) ([]PrecomputedVersion, error) {
 	rulesWithPrecomputedVersions := make([]PrecomputedVersion, 0, len(config.Rules))
 	for _, rule := range config.Rules {
 		precomputedVersions := make([]rd.Version, 0, len(config.Versions))
@@ -370,7 +625,7 @@ func (s *Server) generatePrecomputedVersions(config rd.ResponseConfig) error {
 			precomputedVersion := version
 			supported, err := rule.Supported(version)
 			if err != nil {
-				return fmt.Errorf("failed to compute Supported for Rule %+v and Version %q: %w", rule, version.Name, err)
+				return nil, fmt.Errorf("failed to compute Supported for Rule %+v and Version %q: %w", rule, version.Name, err)
 			}
 			precomputedVersion.Supported = supported
 			precomputedVersions = append(precomputedVersions, precomputedVersion)
@@ -382,6 +637,40 @@ func (s *Server) generatePrecomputedVersions(config rd.ResponseConfig) error {
 		rulesWithPrecomputedVersions = append(rulesWithPrecomputedVersions, newElement)
 	}
 
-	s.PrecomputedVersions = rulesWithPrecomputedVersions
+	return rulesWithPrecomputedVersions, nil
+}
+
+// ValidateConfigFile returns every problem that would prevent the server
+// from using the response config file at configPath: errors parsing it,
+// every validation error, and errors precomputing the versions of each rule.
+func ValidateConfigFile(configPath string) []error {
+	config, err := rd.ParseConfig(configPath)
+	if err != nil {
+		return []error{err}
+	}
+	var errs []error
+	for _, configError := range config.ValidationErrors() {
+		errs = append(errs, configError)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	if _, err := generatePrecomputedVersions(config); err != nil {
+		return []error{err}
+	}
 	return nil
 }
+
+// applyArtifacts returns a copy of versions in which only the Artifacts for
+// the given platform and arch are kept. No Artifacts are kept if the
+// platform of the client is unknown.
+func applyArtifacts(versions []rd.Version, platform, arch string) []rd.Version {
+	result := make([]rd.Version, len(versions))
+	for i, version := range versions {
+		if len(version.Artifacts) > 0 {
+			version.Artifacts = version.ArtifactsFor(platform, arch)
+		}
+		result[i] = version
+	}
+	return result
+}
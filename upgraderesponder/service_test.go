@@ -1,8 +1,18 @@
 package upgraderesponder
 
 import (
-	rd "github.com/longhorn/upgrade-responder/rancherdesktop"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+
+	rd "github.com/longhorn/upgrade-responder/rancherdesktop"
 )
 
 var testConfig rd.ResponseConfig
@@ -16,12 +26,9 @@ func init() {
 }
 
 func getTestServer(t *testing.T, config rd.ResponseConfig) *Server {
-	server := &Server{
-		DefaultVersions: config.Versions,
-	}
-
-	if err := server.generatePrecomputedVersions(config); err != nil {
-		t.Fatalf("failed to generate precomputed versions: %s", err)
+	server := &Server{}
+	if err := server.setConfig(config); err != nil {
+		t.Fatalf("failed to set config: %s", err)
 	}
 	return server
 }
@@ -140,4 +147,436 @@ func TestServer(t *testing.T) {
 			}
 		})
 	})
+
+	t.Run("applyChannel", func(t *testing.T) {
+		versions := []rd.Version{
+			{Name: "1.9.1"},
+			{Name: "1.10.0-rc.1"},
+			{Name: "1.10.0-nightly.20230501"},
+		}
+		for _, testCase := range []struct {
+			Channel       string
+			ExpectedNames string
+		}{
+			{Channel: rd.ChannelStable, ExpectedNames: "1.9.1"},
+			{Channel: rd.ChannelBeta, ExpectedNames: "1.9.1,1.10.0-rc.1"},
+			{Channel: rd.ChannelNightly, ExpectedNames: "1.9.1,1.10.0-rc.1,1.10.0-nightly.20230501"},
+		} {
+			var names []string
+			for _, version := range applyChannel(versions, testCase.Channel, nil) {
+				names = append(names, version.Name)
+			}
+			if strings.Join(names, ",") != testCase.ExpectedNames {
+				t.Errorf("unexpected versions %v on %v", names, testCase.Channel)
+			}
+		}
+	})
+
+	t.Run("applyRollouts", func(t *testing.T) {
+		now := time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+		versions := []rd.Version{
+			{Name: "1.2.3"},
+			{Name: "2.3.4", Rollout: &rd.Rollout{StartTime: now, Percentage: 100}},
+			{Name: "4.5.6", Rollout: &rd.Rollout{StartTime: now, Percentage: 0}},
+			{Name: "5.6.7", Rollout: &rd.Rollout{StartTime: now.Add(time.Hour), Percentage: 100}},
+		}
+
+		result := applyRollouts(versions, "some-instance", nil, now)
+		if len(result) != 2 || result[0].Name != "1.2.3" || result[1].Name != "2.3.4" {
+			t.Fatalf("unexpected versions %+v", result)
+		}
+		if result[1].Rollout != nil {
+			t.Error("Rollout was not removed from the response")
+		}
+		if versions[1].Rollout == nil {
+			t.Error("Rollout was removed from the config")
+		}
+	})
+
+	t.Run("applyArtifacts", func(t *testing.T) {
+		versions := []rd.Version{
+			{
+				Name: "1.2.3",
+				Artifacts: []rd.Artifact{
+					{Platform: "darwin", Arch: "arm64", URL: "https://example.com/rd-arm64.dmg"},
+					{Platform: "darwin", Arch: "x64", URL: "https://example.com/rd-x64.dmg"},
+					{Platform: "win32", Arch: "x64", URL: "https://example.com/rd.msi"},
+				},
+			},
+		}
+
+		result := applyArtifacts(versions, "darwin", "arm64")
+		if len(result[0].Artifacts) != 1 || result[0].Artifacts[0].URL != "https://example.com/rd-arm64.dmg" {
+			t.Errorf("unexpected artifacts %+v", result[0].Artifacts)
+		}
+		if len(versions[0].Artifacts) != 3 {
+			t.Error("artifacts were removed from the config")
+		}
+		if result := applyArtifacts(versions, "", ""); len(result[0].Artifacts) != 0 {
+			t.Errorf("unexpected artifacts %+v for an unknown platform", result[0].Artifacts)
+		}
+	})
+
+	t.Run("applyRetractions", func(t *testing.T) {
+		versions := []rd.Version{
+			{Name: "1.2.3", Supported: true},
+			{Name: "1.2.4", Supported: true, Retracted: &rd.Retraction{Reason: "breaks networking", Replacement: "1.2.5"}},
+			{Name: "1.2.5", Supported: true},
+		}
+
+		result := applyRetractions(versions, semver.MustParse("1.2.3"))
+		if len(result) != 2 || result[0].Name != "1.2.3" || result[1].Name != "1.2.5" {
+			t.Errorf("unexpected versions %+v", result)
+		}
+		if result := applyRetractions(versions, nil); len(result) != 2 {
+			t.Errorf("unexpected versions %+v for an unknown app version", result)
+		}
+
+		result = applyRetractions(versions, semver.MustParse("v1.2.4"))
+		if len(result) != 3 || result[1].Retracted == nil || result[1].Supported {
+			t.Errorf("retracted version was not sent as unsupported to the client running it: %+v", result)
+		}
+		if !versions[1].Supported {
+			t.Error("retracted version was modified in the config")
+		}
+	})
+
+	t.Run("respond", func(t *testing.T) {
+		minPlatformVersionConfig := `{
+			"Rules": [{
+				"Criteria": {"AppVersion": "<1.0.0", "Platform": "darwin", "Arch": "*", "PlatformVersion": "*"},
+				"Constraints": {"EnforceMinPlatformVersion": true}
+			}],
+			"Versions": [
+				{"Name": "1.2.3", "ReleaseDate": "2022-07-28T11:00:00Z", "MinPlatformVersion": {"darwin": "11.0.0"}},
+				{"Name": "4.5.6", "ReleaseDate": "2022-07-28T11:00:00Z", "Tags": ["latest"]}
+			]
+		}`
+		retractionConfig := `{
+			"Versions": [
+				{"Name": "1.2.3", "ReleaseDate": "2022-07-28T11:00:00Z"},
+				{"Name": "1.3.0-rc.1", "ReleaseDate": "2022-07-28T11:00:00Z", "Retracted": {"Reason": "breaks networking"}},
+				{
+					"Name": "2.0.0",
+					"ReleaseDate": "2022-07-28T11:00:00Z",
+					"Rollout": {"StartTime": "2022-07-28T11:00:00Z", "Percentage": 0},
+					"Retracted": {"Reason": "corrupts virtual machines", "Replacement": "4.5.6"}
+				},
+				{"Name": "4.5.6", "ReleaseDate": "2022-07-28T11:00:00Z", "Tags": ["latest"]}
+			]
+		}`
+		endOfLifeConfig := `{
+			"MinimumSupportedVersion": "1.0.0",
+			"Versions": [
+				{"Name": "1.2.3", "ReleaseDate": "2022-07-28T11:00:00Z", "Severity": "critical"},
+				{"Name": "4.5.6", "ReleaseDate": "2022-07-28T11:00:00Z", "Tags": ["latest"]}
+			]
+		}`
+		channelConfig := `{
+			"Versions": [
+				{"Name": "1.2.3", "ReleaseDate": "2022-07-28T11:00:00Z"},
+				{"Name": "4.5.6", "ReleaseDate": "2022-07-28T11:00:00Z", "Tags": ["latest"]},
+				{"Name": "5.0.0-rc.1", "ReleaseDate": "2022-07-28T11:00:00Z"}
+			]
+		}`
+		steppingStoneConfig := `{
+			"Versions": [
+				{"Name": "1.2.3", "ReleaseDate": "2022-07-28T11:00:00Z"},
+				{"Name": "2.0.0", "ReleaseDate": "2022-07-28T11:00:00Z"},
+				{
+					"Name": "2.3.4",
+					"ReleaseDate": "2022-07-28T11:00:00Z",
+					"Rollout": {"StartTime": "2022-07-28T11:00:00Z", "Percentage": 0},
+					"SteppingStone": true
+				},
+				{"Name": "4.5.6", "ReleaseDate": "2022-07-28T11:00:00Z", "Tags": ["latest"]}
+			]
+		}`
+		testCases := []struct {
+			Description string
+			// The response config, as JSON.
+			Config                  string
+			Request                 rd.CheckUpgradeRequest
+			ExpectedNames           string
+			ExpectedUnsupported     string
+			ExpectedEndOfLife       bool
+			ExpectedUpgradeRequired bool
+			ExpectedRecommended     string
+		}{
+			{
+				Description: "should apply Constraints that depend on the request",
+				Config:      minPlatformVersionConfig,
+				Request: rd.CheckUpgradeRequest{
+					AppVersion: "0.9.0",
+					ExtraInfo:  map[string]string{"platform": "darwin-x64", "platformVersion": "10.15.7"},
+				},
+				ExpectedNames:       "1.2.3,4.5.6",
+				ExpectedUnsupported: "1.2.3",
+				ExpectedRecommended: "4.5.6",
+			},
+			{
+				Description: "should support a version at its MinPlatformVersion",
+				Config:      minPlatformVersionConfig,
+				Request: rd.CheckUpgradeRequest{
+					AppVersion: "0.9.0",
+					ExtraInfo:  map[string]string{"platform": "darwin-x64", "platformVersion": "11.0.0"},
+				},
+				ExpectedNames:       "1.2.3,4.5.6",
+				ExpectedUnsupported: "",
+				ExpectedRecommended: "4.5.6",
+			},
+			{
+				Description:             "should tell clients older than MinimumSupportedVersion that they are end-of-life",
+				Config:                  endOfLifeConfig,
+				Request:                 rd.CheckUpgradeRequest{AppVersion: "0.9.0"},
+				ExpectedNames:           "1.2.3,4.5.6",
+				ExpectedEndOfLife:       true,
+				ExpectedUpgradeRequired: true,
+				ExpectedRecommended:     "4.5.6",
+			},
+			{
+				Description:             "should tell clients older than a critical version that they must upgrade",
+				Config:                  endOfLifeConfig,
+				Request:                 rd.CheckUpgradeRequest{AppVersion: "1.0.0"},
+				ExpectedNames:           "1.2.3,4.5.6",
+				ExpectedUpgradeRequired: true,
+				ExpectedRecommended:     "4.5.6",
+			},
+			{
+				Description:         "should not require clients running a critical version to upgrade",
+				Config:              endOfLifeConfig,
+				Request:             rd.CheckUpgradeRequest{AppVersion: "1.2.3"},
+				ExpectedNames:       "1.2.3,4.5.6",
+				ExpectedRecommended: "4.5.6",
+			},
+			{
+				Description:   "should not require clients with an invalid version to upgrade",
+				Config:        endOfLifeConfig,
+				Request:       rd.CheckUpgradeRequest{AppVersion: "invalid"},
+				ExpectedNames: "1.2.3,4.5.6",
+			},
+			{
+				Description:         "should omit retracted versions",
+				Config:              retractionConfig,
+				Request:             rd.CheckUpgradeRequest{AppVersion: "1.2.3"},
+				ExpectedNames:       "1.2.3,4.5.6",
+				ExpectedRecommended: "4.5.6",
+			},
+			{
+				Description:         "should send its retracted version to a client that does not follow its channel",
+				Config:              retractionConfig,
+				Request:             rd.CheckUpgradeRequest{AppVersion: "1.3.0-rc.1"},
+				ExpectedNames:       "1.2.3,1.3.0-rc.1,4.5.6",
+				ExpectedUnsupported: "1.3.0-rc.1",
+				ExpectedRecommended: "4.5.6",
+			},
+			{
+				Description:         "should send its retracted version to a client that is not in its rollout",
+				Config:              retractionConfig,
+				Request:             rd.CheckUpgradeRequest{AppVersion: "2.0.0"},
+				ExpectedNames:       "1.2.3,2.0.0,4.5.6",
+				ExpectedUnsupported: "2.0.0",
+				ExpectedRecommended: "4.5.6",
+			},
+			{
+				Description: "should recommend the newest version on the stable channel",
+				Config:      channelConfig,
+				Request: rd.CheckUpgradeRequest{
+					AppVersion: "1.2.3",
+					ExtraInfo:  map[string]string{rd.ExtraInfoKeyChannel: rd.ChannelStable},
+				},
+				ExpectedNames:       "1.2.3,4.5.6",
+				ExpectedRecommended: "4.5.6",
+			},
+			{
+				Description: "should recommend the newest version on the beta channel",
+				Config:      channelConfig,
+				Request: rd.CheckUpgradeRequest{
+					AppVersion: "1.2.3",
+					ExtraInfo:  map[string]string{rd.ExtraInfoKeyChannel: rd.ChannelBeta},
+				},
+				ExpectedNames:       "1.2.3,4.5.6,5.0.0-rc.1",
+				ExpectedRecommended: "5.0.0-rc.1",
+			},
+			{
+				Description:         "should not recommend a version past a stepping stone that is still in rollout",
+				Config:              steppingStoneConfig,
+				Request:             rd.CheckUpgradeRequest{AppVersion: "1.2.3"},
+				ExpectedNames:       "1.2.3,2.0.0,4.5.6",
+				ExpectedRecommended: "2.0.0",
+			},
+			{
+				Description:         "should recommend the newest version to clients past the stepping stone",
+				Config:              steppingStoneConfig,
+				Request:             rd.CheckUpgradeRequest{AppVersion: "2.3.4"},
+				ExpectedNames:       "1.2.3,2.0.0,2.3.4,4.5.6",
+				ExpectedRecommended: "4.5.6",
+			},
+		}
+		for _, testCase := range testCases {
+			t.Run(testCase.Description, func(t *testing.T) {
+				configFile := filepath.Join(t.TempDir(), "config.json")
+				if err := os.WriteFile(configFile, []byte(testCase.Config), 0644); err != nil {
+					t.Fatalf("failed to write config: %s", err)
+				}
+				config, err := rd.ReadConfig(configFile)
+				if err != nil {
+					t.Fatalf("unexpected error reading config: %s", err)
+				}
+				state := getTestServer(t, config).getState()
+				precomputedVersions, _ := json.Marshal(state.PrecomputedVersions)
+
+				resp, _ := state.respond(testCase.Request, "", time.Now())
+				var names, unsupported []string
+				for _, version := range resp.Versions {
+					names = append(names, version.Name)
+					if !version.Supported {
+						unsupported = append(unsupported, version.Name)
+					}
+				}
+				if strings.Join(names, ",") != testCase.ExpectedNames {
+					t.Errorf("unexpected versions %v", names)
+				}
+				if strings.Join(unsupported, ",") != testCase.ExpectedUnsupported {
+					t.Errorf("unexpected unsupported versions %v", unsupported)
+				}
+				if after, _ := json.Marshal(state.PrecomputedVersions); string(after) != string(precomputedVersions) {
+					t.Error("precomputed versions were modified")
+				}
+				if resp.CurrentVersionEndOfLife != testCase.ExpectedEndOfLife {
+					t.Errorf("unexpected currentVersionEndOfLife %t", resp.CurrentVersionEndOfLife)
+				}
+				if resp.UpgradeRequired != testCase.ExpectedUpgradeRequired {
+					t.Errorf("unexpected upgradeRequired %t", resp.UpgradeRequired)
+				}
+				if resp.Recommended != testCase.ExpectedRecommended {
+					t.Errorf("unexpected recommended %q", resp.Recommended)
+				}
+			})
+		}
+	})
+
+	t.Run("ReloadConfig", func(t *testing.T) {
+
+		copyConfig := func(t *testing.T, src, dst string) {
+			content, err := os.ReadFile(src)
+			if err != nil {
+				t.Fatalf("failed to read %s: %s", src, err)
+			}
+			if err := os.WriteFile(dst, content, 0644); err != nil {
+				t.Fatalf("failed to write %s: %s", dst, err)
+			}
+		}
+
+		t.Run("should replace the config when the new one is valid", func(t *testing.T) {
+			configFile := filepath.Join(t.TempDir(), "config.json")
+			copyConfig(t, "../rancherdesktop/testdata/test-config.json", configFile)
+			server := &Server{configFile: configFile}
+			if err := server.ReloadConfig(); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(server.getState().PrecomputedVersions) != 2 {
+				t.Fatalf("unexpected number of precomputed versions %d", len(server.getState().PrecomputedVersions))
+			}
+
+			copyConfig(t, "testdata/same-constraint-config.json", configFile)
+			if err := server.ReloadConfig(); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			checkUpgradeResponse, err := server.GenerateCheckUpgradeResponse(rd.CheckUpgradeRequest{
+				AppVersion: "1.0.0",
+				ExtraInfo: map[string]string{
+					"platform":        "darwin-x64",
+					"platformVersion": "12.0.3",
+				},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			supportedCount, unsupportedCount := countSupported(checkUpgradeResponse.Versions)
+			if supportedCount != 1 || unsupportedCount != 2 {
+				t.Errorf("unexpected supportedCount %d or unsupportedCount %d", supportedCount, unsupportedCount)
+			}
+		})
+
+		t.Run("should keep the previous config and report the error when the new one is invalid", func(t *testing.T) {
+			configFile := filepath.Join(t.TempDir(), "config.json")
+			copyConfig(t, "../rancherdesktop/testdata/test-config.json", configFile)
+			server := &Server{configFile: configFile}
+			if err := server.ReloadConfig(); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			previousState := server.getState()
+
+			if err := os.WriteFile(configFile, []byte(`{"Versions": []}`), 0644); err != nil {
+				t.Fatalf("failed to write config: %s", err)
+			}
+			if err := server.ReloadConfig(); err == nil {
+				t.Fatal("did not return error for invalid config")
+			}
+			if server.getState() != previousState {
+				t.Error("state was replaced by an invalid config")
+			}
+
+			rw := httptest.NewRecorder()
+			server.HealthCheck(rw, httptest.NewRequest("GET", "/v1/healthcheck", nil))
+			if rw.Code != 200 {
+				t.Errorf("unexpected status code %d", rw.Code)
+			}
+			var healthCheckResponse HealthCheckResponse
+			if err := json.NewDecoder(rw.Body).Decode(&healthCheckResponse); err != nil {
+				t.Fatalf("failed to decode health check response: %s", err)
+			}
+			if healthCheckResponse.Config.LastError == "" {
+				t.Error("health check response does not contain the reload error")
+			}
+		})
+	})
+}
+
+func TestShutdown(t *testing.T) {
+	t.Run("should write pending records before closing the metrics backend", func(t *testing.T) {
+		sink := &fakeSink{}
+		dbCache, err := NewDBCache(time.Hour, 100, 1000, sink)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		server := &Server{geo: noopResolver{}}
+		server.startRecording(sink, dbCache)
+		dbCache.AddRecord(RequestRecord{AppVersion: "1.2.3"})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if count := sink.recordCount(); count != 1 {
+			t.Errorf("unexpected number of records written %d", count)
+		}
+		if !sink.closed {
+			t.Errorf("metrics backend was not closed")
+		}
+	})
+
+	t.Run("should leave the metrics backend open if the records are not written in time", func(t *testing.T) {
+		sink := &fakeSink{}
+		dbCache, err := NewDBCache(time.Hour, 100, 1000, sink)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		server := &Server{geo: noopResolver{}}
+		server.startRecording(sink, dbCache)
+		// Block the final write until the deadline has passed.
+		dbCache.Lock()
+		defer dbCache.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if err := server.Shutdown(ctx); err == nil {
+			t.Errorf("expected error")
+		}
+		if sink.closed {
+			t.Errorf("metrics backend was closed")
+		}
+	})
 }
@@ -0,0 +1,61 @@
+package upgraderesponder
+
+import (
+	"fmt"
+	"time"
+
+	rd "github.com/longhorn/upgrade-responder/rancherdesktop"
+)
+
+// Simulator computes the responses that the server would send to requests
+// for a given ResponseConfig, along with how each response was reached.
+// It does not record requests or look up their location.
+type Simulator struct {
+	state *responseState
+}
+
+// Simulation is the outcome of simulating a single CheckUpgradeRequest.
+type Simulation struct {
+	Request rd.CheckUpgradeRequest `json:"request"`
+	// The ISO code of the country the request was simulated from, if any.
+	Country string `json:"country,omitempty"`
+	// Index in ResponseConfig.Rules of the Rule that applied to the
+	// request, or -1 if none did.
+	RuleIndex int `json:"ruleIndex"`
+	// True if the response contains the default versions, where every
+	// Version is supported, because no Rule applied to the request.
+	UsedDefaultVersions bool `json:"usedDefaultVersions"`
+	// Why no Rule applied to the request, if none did.
+	FallbackReason string                `json:"fallbackReason,omitempty"`
+	Response       *CheckUpgradeResponse `json:"response"`
+}
+
+func NewSimulator(config rd.ResponseConfig) (*Simulator, error) {
+	precomputedVersions, err := generatePrecomputedVersions(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate precomputed versions: %w", err)
+	}
+	return &Simulator{
+		state: newResponseState(config, precomputedVersions),
+	}, nil
+}
+
+// Simulate computes the response to request as if it was received from the
+// country with the given ISO code at the given time. country can be empty
+// to simulate a request whose country is unknown.
+func (simulator *Simulator) Simulate(request rd.CheckUpgradeRequest, country string, now time.Time) Simulation {
+	resp, eval := simulator.state.respond(request, country, now)
+	simulation := Simulation{
+		Request:             request,
+		Country:             country,
+		RuleIndex:           eval.ruleIndex,
+		UsedDefaultVersions: eval.ruleIndex < 0,
+		Response:            resp,
+	}
+	if eval.instanceInfoErr != nil {
+		simulation.FallbackReason = fmt.Sprintf("could not parse request as InstanceInfo: %v", eval.instanceInfoErr)
+	} else if eval.ruleIndex < 0 {
+		simulation.FallbackReason = "no Rule applies to the request"
+	}
+	return simulation
+}
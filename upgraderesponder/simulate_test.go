@@ -0,0 +1,91 @@
+package upgraderesponder
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	rd "github.com/longhorn/upgrade-responder/rancherdesktop"
+)
+
+func TestSimulator(t *testing.T) {
+	simulator, err := NewSimulator(testConfig)
+	if err != nil {
+		t.Fatalf("failed to create simulator: %s", err)
+	}
+	now := time.Now()
+
+	t.Run("should report the index of the Rule that applies", func(t *testing.T) {
+		simulation := simulator.Simulate(rd.CheckUpgradeRequest{
+			AppVersion: "3.5.0",
+			ExtraInfo: map[string]string{
+				"platform":        "darwin-x64",
+				"platformVersion": "12.0.3",
+			},
+		}, "", now)
+		if simulation.RuleIndex != 1 || simulation.UsedDefaultVersions || simulation.FallbackReason != "" {
+			t.Errorf("unexpected simulation %+v", simulation)
+		}
+		supportedCount, unsupportedCount := countSupported(simulation.Response.Versions)
+		if supportedCount != 2 || unsupportedCount != 1 {
+			t.Errorf("unexpected supportedCount %d or unsupportedCount %d", supportedCount, unsupportedCount)
+		}
+	})
+
+	t.Run("should report why the default versions were used when no Rule applies", func(t *testing.T) {
+		simulation := simulator.Simulate(rd.CheckUpgradeRequest{
+			AppVersion: "2.0.0",
+			ExtraInfo: map[string]string{
+				"platform":        "darwin-x64",
+				"platformVersion": "12.0.3",
+			},
+		}, "", now)
+		if simulation.RuleIndex != -1 || !simulation.UsedDefaultVersions {
+			t.Errorf("unexpected simulation %+v", simulation)
+		}
+		if simulation.FallbackReason != "no Rule applies to the request" {
+			t.Errorf("unexpected FallbackReason %q", simulation.FallbackReason)
+		}
+	})
+
+	t.Run("should report why the default versions were used when the request is not an InstanceInfo", func(t *testing.T) {
+		simulation := simulator.Simulate(rd.CheckUpgradeRequest{
+			AppVersion: "1.2.3",
+			ExtraInfo: map[string]string{
+				"platform": "darwin-x64",
+			},
+		}, "", now)
+		if simulation.RuleIndex != -1 || !simulation.UsedDefaultVersions {
+			t.Errorf("unexpected simulation %+v", simulation)
+		}
+		if !strings.Contains(simulation.FallbackReason, "extraInfo.platformVersion not present") {
+			t.Errorf("unexpected FallbackReason %q", simulation.FallbackReason)
+		}
+	})
+
+	t.Run("should match the Countries of a Rule against the simulated country", func(t *testing.T) {
+		config := testConfig
+		config.Rules = []rd.Rule{testConfig.Rules[0]}
+		config.Rules[0].Criteria.Countries = []string{"CA"}
+		simulator, err := NewSimulator(config)
+		if err != nil {
+			t.Fatalf("failed to create simulator: %s", err)
+		}
+		request := rd.CheckUpgradeRequest{
+			AppVersion: "0.9.0",
+			ExtraInfo: map[string]string{
+				"platform":        "darwin-x64",
+				"platformVersion": "12.0.3",
+			},
+		}
+		if simulation := simulator.Simulate(request, "CA", now); simulation.RuleIndex != 0 || simulation.Country != "CA" {
+			t.Errorf("unexpected simulation %+v", simulation)
+		}
+		if simulation := simulator.Simulate(request, "US", now); simulation.RuleIndex != -1 {
+			t.Errorf("unexpected simulation %+v", simulation)
+		}
+		if simulation := simulator.Simulate(request, "", now); simulation.RuleIndex != -1 {
+			t.Errorf("unexpected simulation %+v", simulation)
+		}
+	})
+}
@@ -0,0 +1,210 @@
+package upgraderesponder
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	rd "github.com/longhorn/upgrade-responder/rancherdesktop"
+	"github.com/longhorn/upgrade-responder/utils"
+)
+
+const (
+	MetricsBackendInfluxDB   = "influxdb"
+	MetricsBackendInfluxDB2  = "influxdb2"
+	MetricsBackendPrometheus = "prometheus"
+	MetricsBackendLocal      = "local"
+	MetricsBackendNone       = "none"
+)
+
+// downSampling describes the down sampling done by one of the continuous
+// queries created for InfluxDB 1.x: the number of requests in each period,
+// grouped by GroupColumns, is stored in Measurement. Other backends mirror
+// these.
+type downSampling struct {
+	Name         string
+	Measurement  string
+	GroupColumns []string
+}
+
+var downSamplings = []downSampling{
+	{
+		Name:         InfluxDBContinuousQueryDownSampling,
+		Measurement:  InfluxDBMeasurementDownSampling,
+		GroupColumns: []string{},
+	},
+	{
+		Name:         InfluxDBContinuousQueryByAppVersion,
+		Measurement:  InfluxDBMeasurementByAppVersion,
+		GroupColumns: []string{InfluxDBTagAppVersion},
+	},
+	{
+		Name:         InfluxDBContinuousQueryByCountryCode,
+		Measurement:  InfluxDBMeasurementByCountryCode,
+		GroupColumns: []string{InfluxDBTagLocationCountryISOCode},
+	},
+	{
+		Name:         InfluxDBContinuousQueryByASN,
+		Measurement:  InfluxDBMeasurementByASN,
+		GroupColumns: []string{InfluxDBTagASN, InfluxDBTagASOrganization},
+	},
+}
+
+// RequestRecord is what is stored about a single CheckUpgradeRequest.
+// It must never contain anything that identifies the client, such as its IP.
+type RequestRecord struct {
+	Time       time.Time `json:"time"`
+	AppVersion string    `json:"appVersion"`
+	// ExtraInfo of the request, with keys converted to snake case.
+	ExtraInfo map[string]string `json:"extraInfo,omitempty"`
+	// The location the request came from, or nil if it is unknown.
+	Location *Location `json:"location,omitempty"`
+	// Index of the Rule that applied to the request, or -1 if none did.
+	// It is not part of Tags, since it changes meaning whenever the rules
+	// are edited.
+	RuleIndex int `json:"ruleIndex"`
+	// The number of requests the record stands for, when records are
+	// aggregated. Zero is the same as one.
+	Count int64 `json:"count,omitempty"`
+}
+
+// Requests returns the number of requests the record stands for.
+func (record RequestRecord) Requests() int64 {
+	if record.Count == 0 {
+		return 1
+	}
+	return record.Count
+}
+
+// Tags returns the fields of a RequestRecord as a flat set of tags, keyed
+// by the names used in InfluxDB.
+func (record RequestRecord) Tags() map[string]string {
+	tags := map[string]string{
+		InfluxDBTagAppVersion: record.AppVersion,
+	}
+	for k, v := range record.ExtraInfo {
+		tags[k] = v
+	}
+	if record.Location != nil {
+		tags[InfluxDBTagLocationCity] = record.Location.City
+		tags[InfluxDBTagLocationCountry] = record.Location.Country.Name
+		tags[InfluxDBTagLocationCountryISOCode] = record.Location.Country.ISOCode
+		// Only set when known, so that the series of the existing tags do
+		// not change when the databases providing them are not used.
+		if record.Location.Continent != "" {
+			tags[InfluxDBTagLocationContinent] = record.Location.Continent
+		}
+		if record.Location.ASN != 0 {
+			tags[InfluxDBTagASN] = strconv.FormatUint(uint64(record.Location.ASN), 10)
+			tags[InfluxDBTagASOrganization] = record.Location.ASOrganization
+		}
+	}
+	return tags
+}
+
+// newRequestRecord creates the RequestRecord of req. ExtraInfo keys are
+// converted to snake case, which is how they have always been named in
+// InfluxDB.
+func newRequestRecord(t time.Time, req rd.CheckUpgradeRequest, loc *Location, ruleIndex int) RequestRecord {
+	record := RequestRecord{
+		Time:       t,
+		AppVersion: req.AppVersion,
+		ExtraInfo:  make(map[string]string, len(req.ExtraInfo)),
+		Location:   loc,
+		RuleIndex:  ruleIndex,
+	}
+	for k, v := range req.ExtraInfo {
+		// The instance ID identifies the client, so it must not be stored.
+		if k == rd.ExtraInfoKeyInstanceID {
+			continue
+		}
+		record.ExtraInfo[utils.ToSnakeCase(k)] = v
+	}
+	return record
+}
+
+// Sink stores RequestRecords in a metrics storage backend.
+type Sink interface {
+	// Write stores a batch of records. If it returns an error, it may be
+	// called again with the same records.
+	Write(records []RequestRecord) error
+	Close() error
+}
+
+// rollupSource is implemented by the sinks that roll requests up by
+// themselves, instead of leaving it to the database.
+type rollupSource interface {
+	// Rollups returns the rollups of measurement for the periods starting
+	// in [start, end).
+	Rollups(measurement string, start, end time.Time) ([]Rollup, error)
+}
+
+// newSink creates the Sink for the backend selected by options. It returns
+// nil if requests should not be recorded.
+func newSink(options ServerOptions) (Sink, error) {
+	influxDBOptions := options.InfluxDB
+	influxDBOptions.Aggregated = options.AggregateRequests
+
+	switch options.MetricsBackend {
+	case MetricsBackendInfluxDB, "":
+		if options.InfluxDB.URL == "" {
+			logrus.Infof("No InfluxDB URL specified, requests will not be recorded")
+			return nil, nil
+		}
+		return newInfluxDBSink(influxDBOptions)
+	case MetricsBackendInfluxDB2:
+		if options.InfluxDB.URL == "" {
+			return nil, fmt.Errorf("InfluxDB URL must be specified")
+		}
+		return newInfluxDB2Sink(influxDBOptions)
+	case MetricsBackendPrometheus:
+		return newPrometheusSink(), nil
+	case MetricsBackendLocal:
+		return newLocalSink(options.LocalStorage)
+	case MetricsBackendNone:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown metrics backend %q", options.MetricsBackend)
+}
+
+// periodStart returns the start of the period t is in. Like GROUP BY time()
+// in InfluxDB, periods are aligned on the Unix epoch.
+func periodStart(t time.Time, period time.Duration) time.Time {
+	return time.Unix(0, t.UnixNano()-t.UnixNano()%int64(period)).UTC()
+}
+
+// aggregateRecords merges the records that have the same tags and rule
+// during the same query period into a single record. Its Count is the
+// number of requests of the merged records, and its Time the earliest of
+// theirs, so that it is counted in the same period. The first record of
+// each group determines the order of the result.
+func aggregateRecords(records []RequestRecord, period time.Duration) []RequestRecord {
+	var result []RequestRecord
+	indexes := map[string]int{}
+	for _, record := range records {
+		key := fmt.Sprintf("%d\x00%d\x00%v", periodStart(record.Time, period).UnixNano(), record.RuleIndex, rollupKey("", record.Tags()))
+		i, ok := indexes[key]
+		if !ok {
+			indexes[key] = len(result)
+			record.Count = record.Requests()
+			result = append(result, record)
+			continue
+		}
+		result[i].Count += record.Requests()
+		if record.Time.Before(result[i].Time) {
+			result[i].Time = record.Time
+		}
+	}
+	return result
+}
+
+// countRequests returns the number of requests records stand for.
+func countRequests(records []RequestRecord) int64 {
+	var count int64
+	for _, record := range records {
+		count += record.Requests()
+	}
+	return count
+}
@@ -0,0 +1,301 @@
+package upgraderesponder
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	rd "github.com/longhorn/upgrade-responder/rancherdesktop"
+)
+
+// fakeSink records the batches written to it, and fails the first
+// failures writes.
+type fakeSink struct {
+	sync.Mutex
+	failures int
+	batches  [][]RequestRecord
+	closed   bool
+}
+
+func (sink *fakeSink) Write(records []RequestRecord) error {
+	sink.Lock()
+	defer sink.Unlock()
+	if sink.failures > 0 {
+		sink.failures--
+		return errors.New("fake failure")
+	}
+	sink.batches = append(sink.batches, append([]RequestRecord(nil), records...))
+	return nil
+}
+
+func (sink *fakeSink) Close() error {
+	sink.Lock()
+	defer sink.Unlock()
+	sink.closed = true
+	return nil
+}
+
+func (sink *fakeSink) recordCount() int {
+	sink.Lock()
+	defer sink.Unlock()
+	count := 0
+	for _, batch := range sink.batches {
+		count += len(batch)
+	}
+	return count
+}
+
+func TestRequestRecord(t *testing.T) {
+	t.Run("newRequestRecord should convert ExtraInfo keys to snake case and omit the instance ID", func(t *testing.T) {
+		record := newRequestRecord(time.Now(), rd.CheckUpgradeRequest{
+			AppVersion: "1.2.3",
+			ExtraInfo: map[string]string{
+				"platformVersion":         "12.0.3",
+				rd.ExtraInfoKeyInstanceID: "some-instance",
+			},
+		}, nil, -1)
+		if len(record.ExtraInfo) != 1 || record.ExtraInfo["platform_version"] != "12.0.3" {
+			t.Errorf("unexpected ExtraInfo %v", record.ExtraInfo)
+		}
+	})
+
+	t.Run("Tags should contain every field of the record", func(t *testing.T) {
+		loc := &Location{City: "Toronto"}
+		loc.Country.Name = "Canada"
+		loc.Country.ISOCode = "CA"
+		record := RequestRecord{
+			AppVersion: "1.2.3",
+			ExtraInfo:  map[string]string{"platform": "darwin-x64"},
+			Location:   loc,
+		}
+		expectedTags := map[string]string{
+			InfluxDBTagAppVersion:             "1.2.3",
+			"platform":                        "darwin-x64",
+			InfluxDBTagLocationCity:           "Toronto",
+			InfluxDBTagLocationCountry:        "Canada",
+			InfluxDBTagLocationCountryISOCode: "CA",
+		}
+		tags := record.Tags()
+		if len(tags) != len(expectedTags) {
+			t.Fatalf("unexpected tags %v", tags)
+		}
+		for k, v := range expectedTags {
+			if tags[k] != v {
+				t.Errorf("unexpected value %q for tag %q", tags[k], k)
+			}
+		}
+	})
+}
+
+func TestAggregateRecords(t *testing.T) {
+	start := time.Date(2026, 10, 16, 13, 0, 0, 0, time.UTC)
+	records := []RequestRecord{
+		{Time: start.Add(20 * time.Minute), AppVersion: "1.2.3", RuleIndex: 0},
+		{Time: start.Add(10 * time.Minute), AppVersion: "1.2.3", RuleIndex: 0},
+		{Time: start.Add(30 * time.Minute), AppVersion: "2.3.4", RuleIndex: 0},
+		{Time: start.Add(40 * time.Minute), AppVersion: "1.2.3", RuleIndex: 1},
+		{Time: start.Add(70 * time.Minute), AppVersion: "1.2.3", RuleIndex: 0},
+		{Time: start.Add(50 * time.Minute), AppVersion: "1.2.3", RuleIndex: 0, Count: 3},
+	}
+
+	aggregated := aggregateRecords(records, time.Hour)
+	expected := []RequestRecord{
+		{Time: start.Add(10 * time.Minute), AppVersion: "1.2.3", RuleIndex: 0, Count: 5},
+		{Time: start.Add(30 * time.Minute), AppVersion: "2.3.4", RuleIndex: 0, Count: 1},
+		{Time: start.Add(40 * time.Minute), AppVersion: "1.2.3", RuleIndex: 1, Count: 1},
+		{Time: start.Add(70 * time.Minute), AppVersion: "1.2.3", RuleIndex: 0, Count: 1},
+	}
+	if len(aggregated) != len(expected) {
+		t.Fatalf("unexpected records %+v", aggregated)
+	}
+	for i := range expected {
+		if !aggregated[i].Time.Equal(expected[i].Time) || aggregated[i].AppVersion != expected[i].AppVersion ||
+			aggregated[i].RuleIndex != expected[i].RuleIndex || aggregated[i].Count != expected[i].Count {
+			t.Errorf("unexpected record %+v, expected %+v", aggregated[i], expected[i])
+		}
+	}
+	if countRequests(aggregated) != countRequests(records) {
+		t.Errorf("aggregation changed the number of requests")
+	}
+}
+
+func TestDBCache(t *testing.T) {
+	t.Run("Sync should write cached records to the sink and retry on failure after a backoff", func(t *testing.T) {
+		sink := &fakeSink{failures: 2}
+		cache, err := NewDBCache(time.Hour, 100, 1000, sink)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		cache.AddRecord(RequestRecord{AppVersion: "1.2.3"})
+		cache.AddRecord(RequestRecord{AppVersion: "2.3.4"})
+		cache.Sync()
+		if cache.backoff != minSyncBackoff {
+			t.Errorf("unexpected backoff %v", cache.backoff)
+		}
+		if stats := cache.Stats(); stats.Queued != 2 || stats.Failed != 0 {
+			t.Errorf("unexpected stats %+v", stats)
+		}
+		cache.Sync()
+		if sink.failures != 1 {
+			t.Errorf("write was retried before the backoff")
+		}
+
+		cache.nextAttempt = time.Time{}
+		cache.Sync()
+		if cache.backoff != 2*minSyncBackoff {
+			t.Errorf("unexpected backoff %v", cache.backoff)
+		}
+		cache.nextAttempt = time.Time{}
+		cache.Sync()
+		if count := sink.recordCount(); count != 2 {
+			t.Errorf("unexpected number of records written %d", count)
+		}
+		if cache.backoff != 0 {
+			t.Errorf("backoff was not reset")
+		}
+		cache.Sync()
+		if len(sink.batches) != 1 {
+			t.Errorf("unexpected number of batches written %d", len(sink.batches))
+		}
+	})
+	t.Run("AddRecord should drop records without blocking when the queue is full", func(t *testing.T) {
+		sink := &fakeSink{}
+		cache, err := NewDBCache(time.Hour, 2, 3, sink)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		// Nothing drains the queue, since Run is not running.
+		for i := 0; i < 5; i++ {
+			cache.AddRecord(RequestRecord{AppVersion: "1.2.3"})
+		}
+		stats := cache.Stats()
+		if stats.Queued != 3 || stats.Added != 3 || stats.Dropped != 2 {
+			t.Errorf("unexpected stats %+v", stats)
+		}
+
+		cache.Sync()
+		stats = cache.Stats()
+		if stats.Queued != 0 || stats.Written != 3 || sink.recordCount() != 3 {
+			t.Errorf("unexpected stats %+v", stats)
+		}
+	})
+
+	t.Run("should count the records that could not be written nor kept", func(t *testing.T) {
+		sink := &fakeSink{failures: 2}
+		cache, err := NewDBCache(time.Hour, 1, 2, sink)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		cache.AddRecord(RequestRecord{AppVersion: "1.2.3"})
+		cache.AddRecord(RequestRecord{AppVersion: "1.2.3"})
+		cache.Sync()
+		cache.AddRecord(RequestRecord{AppVersion: "2.3.4"})
+		cache.nextAttempt = time.Time{}
+		cache.Sync()
+		if stats := cache.Stats(); stats.Failed != 1 || stats.Queued != 2 || stats.Written != 0 {
+			t.Errorf("unexpected stats %+v", stats)
+		}
+
+		cache.nextAttempt = time.Time{}
+		cache.Sync()
+		if len(sink.batches) != 1 || len(sink.batches[0]) != 2 || sink.batches[0][1].AppVersion != "2.3.4" {
+			t.Errorf("unexpected batches %+v", sink.batches)
+		}
+		if stats := cache.Stats(); stats.Failed != 1 || stats.Queued != 0 || stats.Written != 2 {
+			t.Errorf("unexpected stats %+v", stats)
+		}
+	})
+
+	t.Run("NewDBCache should reject a queue smaller than the cache size", func(t *testing.T) {
+		if _, err := NewDBCache(time.Hour, 100, 10, &fakeSink{}); err == nil {
+			t.Errorf("expected error")
+		}
+	})
+
+	t.Run("should write every record added concurrently with Run and Sync", func(t *testing.T) {
+		const (
+			writers          = 8
+			recordsPerWriter = 500
+		)
+		sink := &fakeSink{}
+		cache, err := NewDBCache(time.Millisecond, 10, writers*recordsPerWriter, sink)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		stop := make(chan struct{})
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			cache.Run(stop)
+		}()
+
+		var wg sync.WaitGroup
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < recordsPerWriter; j++ {
+					cache.AddRecord(RequestRecord{AppVersion: "1.2.3"})
+					if j%100 == 0 {
+						cache.Sync()
+						cache.Stats()
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		close(stop)
+		<-stopped
+
+		if count := sink.recordCount(); count != writers*recordsPerWriter {
+			t.Errorf("unexpected number of records written %d", count)
+		}
+		if stats := cache.Stats(); stats.Dropped != 0 || stats.Queued != 0 || stats.Written != writers*recordsPerWriter {
+			t.Errorf("unexpected stats %+v", stats)
+		}
+	})
+
+	t.Run("AddRecord should not block while a write is in progress", func(t *testing.T) {
+		sink := &fakeSink{}
+		cache, err := NewDBCache(time.Hour, 1, 10, sink)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		// Simulate a slow write by holding the lock taken by Sync.
+		cache.Lock()
+		defer cache.Unlock()
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 20; i++ {
+				cache.AddRecord(RequestRecord{AppVersion: "1.2.3"})
+			}
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("AddRecord blocked")
+		}
+	})
+	t.Run("Sync should aggregate records when an aggregation period is set", func(t *testing.T) {
+		sink := &fakeSink{}
+		cache, err := NewDBCache(time.Hour, 100, 1000, sink)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		cache.AggregationPeriod = time.Hour
+		now := time.Now()
+		for i := 0; i < 3; i++ {
+			cache.AddRecord(RequestRecord{Time: now, AppVersion: "1.2.3"})
+		}
+		cache.Sync()
+		if len(sink.batches) != 1 || len(sink.batches[0]) != 1 || sink.batches[0][0].Count != 3 {
+			t.Errorf("unexpected batches %+v", sink.batches)
+		}
+		if stats := cache.Stats(); stats.Added != 3 || stats.Written != 3 {
+			t.Errorf("unexpected stats %+v", stats)
+		}
+	})
+}
@@ -0,0 +1,345 @@
+package upgraderesponder
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// SpoolDropOldest discards the oldest records to make room for new ones
+	// once the spool is full.
+	SpoolDropOldest = "drop-oldest"
+	// SpoolDropNewest discards new records while the spool is full.
+	SpoolDropNewest = "drop-newest"
+
+	spoolSegmentExt = ".jsonl"
+)
+
+// errSpoolFull is returned by Spool.Append when a record is dropped.
+var errSpoolFull = errors.New("spool is full")
+
+// SpoolOptions configures the Spool of a DBCache.
+type SpoolOptions struct {
+	// The directory the spool is kept in. No spool is used if it is empty.
+	Dir string
+	// The maximum total size of the segments, in bytes.
+	MaxBytes int64
+	// What to drop once MaxBytes is reached: SpoolDropOldest or
+	// SpoolDropNewest.
+	DropPolicy string
+}
+
+// Spool is an on-disk queue of RequestRecords waiting to be written to a
+// Sink. Records are appended to the active segment, one JSON object per
+// line. Sealing the active segment flushes it to disk and makes it
+// available to be drained, and a segment is removed once its records are
+// written. Segments left over by a previous run are sealed when the spool
+// is opened, so that they are replayed.
+//
+// Append only writes to the active segment, so that it never waits for
+// the disk to flush. Segments are flushed, closed and removed by Seal,
+// Drain and Close, without holding the lock that Append takes.
+type Spool struct {
+	sync.Mutex
+	dir        string
+	maxBytes   int64
+	dropPolicy string
+	// The sealed segments, keyed by sequence number.
+	sealed map[uint64]spoolSegment
+	// The sealed segment being written by Drain, which is never evicted,
+	// if draining is set.
+	drainingSeq uint64
+	draining    bool
+	active      *os.File
+	// The sequence number of the active segment, and what it holds.
+	activeSeq     uint64
+	activeSegment spoolSegment
+	// The files of the segments that were sealed by Append, and the
+	// segments that were evicted by Append, left for Seal to flush, close
+	// and remove.
+	unclosed  []*os.File
+	unremoved []uint64
+	// The number of spooled requests dropped with their segment to make
+	// room for new ones.
+	evicted uint64
+	// Replaced in tests.
+	syncFile func(*os.File) error
+}
+
+// spoolSegment describes what a segment holds.
+type spoolSegment struct {
+	bytes    int64
+	requests int64
+}
+
+func NewSpool(options SpoolOptions) (*Spool, error) {
+	switch options.DropPolicy {
+	case SpoolDropOldest, SpoolDropNewest:
+	default:
+		return nil, fmt.Errorf("unknown spool drop policy %q", options.DropPolicy)
+	}
+	if options.MaxBytes <= 0 {
+		return nil, fmt.Errorf("spool size must be positive")
+	}
+	if err := os.MkdirAll(options.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &Spool{
+		dir:        options.Dir,
+		maxBytes:   options.MaxBytes,
+		dropPolicy: options.DropPolicy,
+		sealed:     map[uint64]spoolSegment{},
+		syncFile:   (*os.File).Sync,
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), spoolSegmentExt), 10, 64)
+		if err != nil || entry.IsDir() || filepath.Ext(entry.Name()) != spoolSegmentExt {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		// The requests are counted so that they can be reported if the
+		// segment is evicted.
+		records, err := readSpoolSegment(s.segmentPath(seq))
+		if err != nil {
+			return nil, err
+		}
+		s.sealed[seq] = spoolSegment{bytes: info.Size(), requests: countRequests(records)}
+		if seq >= s.activeSeq {
+			s.activeSeq = seq + 1
+		}
+	}
+	if len(s.sealed) > 0 {
+		logrus.Infof("Found %v spooled segment(s) in %v to replay", len(s.sealed), s.dir)
+	}
+	return s, nil
+}
+
+func (s *Spool) segmentPath(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%v", seq, spoolSegmentExt))
+}
+
+func (s *Spool) size() int64 {
+	size := s.activeSegment.bytes
+	for _, segment := range s.sealed {
+		size += segment.bytes
+	}
+	return size
+}
+
+// Append stores record in the active segment. If the spool is full, either
+// the oldest segments or record are dropped depending on the drop policy;
+// errSpoolFull is returned in the latter case. With SpoolDropOldest, the
+// active segment is sealed and dropped if there is no other segment to
+// drop, and record is only dropped if it does not fit in the spool by
+// itself. The files of dropped segments are removed by the next Seal.
+func (s *Spool) Append(record RequestRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.Lock()
+	defer s.Unlock()
+
+	for s.size()+int64(len(line)) > s.maxBytes {
+		oldest, ok := s.evictable()
+		if !ok && s.dropPolicy == SpoolDropOldest && s.active != nil {
+			s.unclosed = append(s.unclosed, s.detachActive())
+			oldest, ok = s.evictable()
+		}
+		if s.dropPolicy != SpoolDropOldest || !ok {
+			return errSpoolFull
+		}
+		segment := s.sealed[oldest]
+		logrus.Warnf("Spool is full, dropped the segment %v of %v bytes", oldest, segment.bytes)
+		s.evicted += uint64(segment.requests)
+		delete(s.sealed, oldest)
+		s.unremoved = append(s.unremoved, oldest)
+	}
+
+	if s.active == nil {
+		s.active, err = os.OpenFile(s.segmentPath(s.activeSeq), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := s.active.Write(line); err != nil {
+		return err
+	}
+	s.activeSegment.bytes += int64(len(line))
+	s.activeSegment.requests += record.Requests()
+	return nil
+}
+
+// evictable returns the oldest sealed segment that is not being drained.
+func (s *Spool) evictable() (uint64, bool) {
+	for _, seq := range s.sortedSealed() {
+		if !s.draining || seq != s.drainingSeq {
+			return seq, true
+		}
+	}
+	return 0, false
+}
+
+// Seal flushes the records appended so far to disk, and makes them
+// available to Drain. It also removes the segments evicted by Append.
+func (s *Spool) Seal() error {
+	s.Lock()
+	unclosed, unremoved := s.unclosed, s.unremoved
+	s.unclosed, s.unremoved = nil, nil
+	if s.active != nil {
+		unclosed = append(unclosed, s.detachActive())
+	}
+	s.Unlock()
+
+	// Append can go on while the segments are flushed.
+	var err error
+	for _, f := range unclosed {
+		if syncErr := s.syncFile(f); syncErr != nil && err == nil {
+			err = syncErr
+		}
+		if closeErr := f.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	for _, seq := range unremoved {
+		if removeErr := os.Remove(s.segmentPath(seq)); removeErr != nil && !os.IsNotExist(removeErr) && err == nil {
+			err = removeErr
+		}
+	}
+	return err
+}
+
+// detachActive seals the active segment and returns its file, which the
+// caller must flush and close.
+func (s *Spool) detachActive() *os.File {
+	active := s.active
+	s.sealed[s.activeSeq] = s.activeSegment
+	s.active = nil
+	s.activeSeq++
+	s.activeSegment = spoolSegment{}
+	return active
+}
+
+func (s *Spool) sortedSealed() []uint64 {
+	seqs := make([]uint64, 0, len(s.sealed))
+	for seq := range s.sealed {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs
+}
+
+// Drain writes the sealed segments to sink, oldest first, and removes
+// each one once it is written. It stops at the first error, leaving the
+// remaining segments for the next call. It returns the number of requests
+// written.
+func (s *Spool) Drain(sink Sink) (int64, error) {
+	var written int64
+	s.Lock()
+	seqs := s.sortedSealed()
+	s.Unlock()
+
+	defer func() {
+		s.Lock()
+		s.draining = false
+		s.Unlock()
+	}()
+	for _, seq := range seqs {
+		s.Lock()
+		_, ok := s.sealed[seq]
+		s.drainingSeq, s.draining = seq, ok
+		s.Unlock()
+		if !ok {
+			// Evicted by Append in the meantime.
+			continue
+		}
+
+		records, err := readSpoolSegment(s.segmentPath(seq))
+		if err != nil {
+			return written, err
+		}
+		if len(records) > 0 {
+			if err := sink.Write(records); err != nil {
+				return written, err
+			}
+			logrus.Debugf("synced %v spooled points to database", len(records))
+		}
+
+		if err := os.Remove(s.segmentPath(seq)); err != nil && !os.IsNotExist(err) {
+			return written, err
+		}
+		s.Lock()
+		delete(s.sealed, seq)
+		s.Unlock()
+		written += countRequests(records)
+	}
+	return written, nil
+}
+
+// readSpoolSegment reads the records of a segment. Lines that cannot be
+// parsed, such as one cut short by a crash, are skipped.
+func readSpoolSegment(path string) ([]RequestRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []RequestRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		var record RequestRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			logrus.Errorf("Skipped an invalid record in %v: %v", path, err)
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// Requests returns the number of requests in the spool.
+func (s *Spool) Requests() int64 {
+	s.Lock()
+	defer s.Unlock()
+	requests := s.activeSegment.requests
+	for _, segment := range s.sealed {
+		requests += segment.requests
+	}
+	return requests
+}
+
+// Evicted returns the number of spooled requests dropped to make room for
+// new ones.
+func (s *Spool) Evicted() uint64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.evicted
+}
+
+// Close flushes and closes the active segment. Its records are replayed by
+// the next Spool opened on the same directory.
+func (s *Spool) Close() error {
+	return s.Seal()
+}
@@ -0,0 +1,323 @@
+package upgraderesponder
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSpool(t *testing.T, dir string, maxBytes int64, dropPolicy string) *Spool {
+	spool, err := NewSpool(SpoolOptions{Dir: dir, MaxBytes: maxBytes, DropPolicy: dropPolicy})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return spool
+}
+
+func TestSpool(t *testing.T) {
+	record := RequestRecord{
+		Time:       time.Date(2026, 10, 16, 13, 0, 0, 0, time.UTC),
+		AppVersion: "1.2.3",
+		ExtraInfo:  map[string]string{"platform": "darwin-x64"},
+		RuleIndex:  2,
+	}
+
+	t.Run("Drain should write the sealed records and remove them", func(t *testing.T) {
+		spool := newTestSpool(t, t.TempDir(), 1024*1024, SpoolDropOldest)
+		sink := &fakeSink{}
+		for i := 0; i < 3; i++ {
+			if err := spool.Append(record); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+		if _, err := spool.Drain(sink); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if count := sink.recordCount(); count != 0 {
+			t.Errorf("unsealed records were written: %d", count)
+		}
+
+		if err := spool.Seal(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := spool.Drain(sink); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if count := sink.recordCount(); count != 3 {
+			t.Errorf("unexpected number of records written %d", count)
+		}
+		written := sink.batches[0][0]
+		if written.AppVersion != record.AppVersion || !written.Time.Equal(record.Time) ||
+			written.ExtraInfo["platform"] != "darwin-x64" || written.RuleIndex != 2 {
+			t.Errorf("unexpected record %+v", written)
+		}
+		if _, err := spool.Drain(sink); err != nil || len(sink.batches) != 1 {
+			t.Errorf("records were written twice")
+		}
+	})
+
+	t.Run("should keep the records when the write fails", func(t *testing.T) {
+		spool := newTestSpool(t, t.TempDir(), 1024*1024, SpoolDropOldest)
+		sink := &fakeSink{failures: 1}
+		if err := spool.Append(record); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		spool.Seal()
+		if _, err := spool.Drain(sink); err == nil {
+			t.Fatalf("expected error")
+		}
+		if _, err := spool.Drain(sink); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if count := sink.recordCount(); count != 1 {
+			t.Errorf("unexpected number of records written %d", count)
+		}
+	})
+
+	t.Run("should replay the records of a previous run", func(t *testing.T) {
+		dir := t.TempDir()
+		spool := newTestSpool(t, dir, 1024*1024, SpoolDropOldest)
+		if err := spool.Append(record); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := spool.Close(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		spool = newTestSpool(t, dir, 1024*1024, SpoolDropOldest)
+		sink := &fakeSink{}
+		if err := spool.Append(record); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := spool.Drain(sink); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if count := sink.recordCount(); count != 1 {
+			t.Errorf("unexpected number of records replayed %d", count)
+		}
+	})
+
+	t.Run("should apply the drop policy when full", func(t *testing.T) {
+		for _, tc := range []struct {
+			Description     string
+			DropPolicy      string
+			Sealed          bool
+			ExpectedWritten int
+			ExpectedFull    bool
+			ExpectedEvicted uint64
+		}{
+			{
+				Description:     "drop-oldest should remove the oldest sealed segment",
+				DropPolicy:      SpoolDropOldest,
+				Sealed:          true,
+				ExpectedWritten: 1,
+				ExpectedEvicted: 2,
+			},
+			{
+				Description:     "drop-oldest should seal and remove the active segment if none is sealed",
+				DropPolicy:      SpoolDropOldest,
+				Sealed:          false,
+				ExpectedWritten: 1,
+				ExpectedEvicted: 2,
+			},
+			{
+				Description:     "drop-newest should reject the new record",
+				DropPolicy:      SpoolDropNewest,
+				Sealed:          true,
+				ExpectedWritten: 2,
+				ExpectedFull:    true,
+			},
+		} {
+			t.Run(tc.Description, func(t *testing.T) {
+				dir := t.TempDir()
+				spool := newTestSpool(t, dir, 1024*1024, tc.DropPolicy)
+				spool.Append(record)
+				spool.Append(record)
+				if tc.Sealed {
+					spool.Seal()
+				}
+				// Leave room for exactly the two spooled records.
+				spool.maxBytes = spool.size()
+
+				err := spool.Append(record)
+				if tc.ExpectedFull && err != errSpoolFull {
+					t.Errorf("unexpected error %v", err)
+				} else if !tc.ExpectedFull && err != nil {
+					t.Errorf("unexpected error %v", err)
+				}
+				spool.Seal()
+				sink := &fakeSink{}
+				if _, err := spool.Drain(sink); err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				if count := sink.recordCount(); count != tc.ExpectedWritten {
+					t.Errorf("unexpected number of records written %d", count)
+				}
+				if evicted := spool.Evicted(); evicted != tc.ExpectedEvicted {
+					t.Errorf("unexpected number of records evicted %d", evicted)
+				}
+			})
+		}
+	})
+
+	t.Run("should count the requests of the segments left over by a previous run", func(t *testing.T) {
+		dir := t.TempDir()
+		spool := newTestSpool(t, dir, 1024*1024, SpoolDropOldest)
+		spool.Append(record)
+		spool.Append(RequestRecord{Time: record.Time, AppVersion: "1.2.3", Count: 5})
+		if err := spool.Close(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		spool = newTestSpool(t, dir, 1024*1024, SpoolDropOldest)
+		spool.maxBytes = spool.size()
+		spool.Append(record)
+		if evicted := spool.Evicted(); evicted != 6 {
+			t.Errorf("unexpected number of requests evicted %d", evicted)
+		}
+	})
+
+	t.Run("NewSpool should reject an unknown drop policy", func(t *testing.T) {
+		if _, err := NewSpool(SpoolOptions{Dir: t.TempDir(), MaxBytes: 1, DropPolicy: "foo"}); err == nil {
+			t.Errorf("expected error")
+		}
+	})
+}
+
+func TestDBCacheSpool(t *testing.T) {
+	t.Run("Sync should back off after a failed write", func(t *testing.T) {
+		dir := t.TempDir()
+		sink := &fakeSink{failures: 1}
+		cache, err := NewDBCache(time.Hour, 100, 1000, sink)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		cache.Spool = newTestSpool(t, dir, 1024*1024, SpoolDropOldest)
+
+		cache.AddRecord(RequestRecord{AppVersion: "1.2.3"})
+		cache.Sync()
+		if cache.backoff != minSyncBackoff {
+			t.Errorf("unexpected backoff %v", cache.backoff)
+		}
+		if stats := cache.Stats(); stats.Queued != 1 {
+			t.Errorf("the spooled request is not reported as queued: %+v", stats)
+		}
+		cache.Sync()
+		if count := sink.recordCount(); count != 0 {
+			t.Errorf("write was retried before the backoff: %d", count)
+		}
+
+		cache.nextAttempt = time.Time{}
+		cache.Sync()
+		if count := sink.recordCount(); count != 1 {
+			t.Errorf("unexpected number of records written %d", count)
+		}
+		if cache.backoff != 0 {
+			t.Errorf("backoff was not reset")
+		}
+		if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+			t.Errorf("unexpected segments left %v", entries)
+		}
+	})
+
+	t.Run("AddRecord should spool records before returning, without a queue", func(t *testing.T) {
+		dir := t.TempDir()
+		sink := &fakeSink{}
+		// The queue, which is not used with a spool, only has room for one
+		// record.
+		cache, err := NewDBCache(time.Hour, 1, 1, sink)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		cache.Spool = newTestSpool(t, dir, 1024*1024, SpoolDropOldest)
+
+		for i := 0; i < 3; i++ {
+			cache.AddRecord(RequestRecord{AppVersion: "1.2.3"})
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil || len(entries) != 1 {
+			t.Fatalf("unexpected segments %v, error %v", entries, err)
+		}
+		content, err := os.ReadFile(filepath.Join(dir, entries[0].Name()))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if lines := strings.Count(string(content), "\n"); lines != 3 {
+			t.Errorf("unexpected number of records spooled before the sync %d", lines)
+		}
+		if stats := cache.Stats(); stats.Added != 3 || stats.Dropped != 0 || stats.Queued != 3 {
+			t.Errorf("unexpected stats %+v", stats)
+		}
+
+		cache.Sync()
+		if count := sink.recordCount(); count != 3 {
+			t.Errorf("unexpected number of records written %d", count)
+		}
+		if stats := cache.Stats(); stats.Written != 3 || stats.Queued != 0 {
+			t.Errorf("unexpected stats %+v", stats)
+		}
+	})
+
+	t.Run("AddRecord should not wait for the spool to be flushed", func(t *testing.T) {
+		cache, err := NewDBCache(time.Hour, 100, 1000, &fakeSink{})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		cache.Spool = newTestSpool(t, t.TempDir(), 1024*1024, SpoolDropOldest)
+		flushing := make(chan struct{})
+		flushed := make(chan struct{})
+		cache.Spool.syncFile = func(f *os.File) error {
+			close(flushing)
+			<-flushed
+			return f.Sync()
+		}
+		cache.AddRecord(RequestRecord{AppVersion: "1.2.3"})
+		sealed := make(chan error)
+		go func() {
+			sealed <- cache.Spool.Seal()
+		}()
+		<-flushing
+
+		added := make(chan struct{})
+		go func() {
+			cache.AddRecord(RequestRecord{AppVersion: "1.2.3"})
+			close(added)
+		}()
+		select {
+		case <-added:
+		case <-time.After(5 * time.Second):
+			t.Error("AddRecord waited for Seal")
+		}
+		close(flushed)
+		if err := <-sealed; err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		<-added
+		if stats := cache.Stats(); stats.Added != 2 {
+			t.Errorf("unexpected stats %+v", stats)
+		}
+	})
+
+	t.Run("Sync should aggregate spooled records when an aggregation period is set", func(t *testing.T) {
+		sink := &fakeSink{}
+		cache, err := NewDBCache(time.Hour, 100, 1000, sink)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		cache.Spool = newTestSpool(t, t.TempDir(), 1024*1024, SpoolDropOldest)
+		cache.AggregationPeriod = time.Hour
+		now := time.Now()
+		for i := 0; i < 3; i++ {
+			cache.AddRecord(RequestRecord{Time: now, AppVersion: "1.2.3"})
+		}
+		cache.Sync()
+		if len(sink.batches) != 1 || len(sink.batches[0]) != 1 || sink.batches[0][0].Count != 3 {
+			t.Errorf("unexpected batches %+v", sink.batches)
+		}
+		if stats := cache.Stats(); stats.Written != 3 {
+			t.Errorf("unexpected stats %+v", stats)
+		}
+	})
+}